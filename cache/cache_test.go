@@ -0,0 +1,108 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNegative(t *testing.T) {
+	n := NewNegative(2, 50*time.Millisecond)
+
+	n.Add("a", errors.New("a"))
+	n.Add("b", errors.New("b"))
+
+	if err := n.Get("a"); err == nil || err.Error() != "a" {
+		t.Errorf("Expected error 'a', got %v\n", err)
+	}
+
+	n.Add("c", errors.New("c"))
+
+	if n.Len() != 2 {
+		t.Errorf("Expected 2 entries, got %v\n", n.Len())
+	}
+
+	if err := n.Get("a"); err != nil {
+		t.Errorf("Expected 'a' to be evicted, got %v\n", err)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if err := n.Get("c"); err != nil {
+		t.Errorf("Expected 'c' to be expired, got %v\n", err)
+	}
+
+	disabled := NewNegative(0, time.Second)
+	disabled.Add("a", fmt.Errorf("a"))
+
+	if err := disabled.Get("a"); err != nil {
+		t.Errorf("Expected nothing from disabled cache, got %v\n", err)
+	}
+}
+
+func TestDisk(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagio-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	// budget for two entries, each one is a checksum and 10 bytes
+	d, err := NewDisk(dir, 2*(sha256.Size+10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if err := d.Add(key, bytes.Repeat([]byte(key), 10)); err != nil {
+			t.Fatalf("Unable to add %v. %v\n", key, err)
+		}
+	}
+
+	if b, found := d.Get("a"); !found || string(b) != "aaaaaaaaaa" {
+		t.Errorf("Expected 'aaaaaaaaaa', got '%s', %v\n", b, found)
+	}
+
+	d.Add("c", bytes.Repeat([]byte("c"), 10))
+
+	if _, found := d.Get("b"); found {
+		t.Errorf("Expected 'b' to be evicted\n")
+	}
+
+	if d.Len() != 2 || d.Used() != 2*(sha256.Size+10) {
+		t.Errorf("Expected 2 entries of %v bytes, got %v of %v\n", 2*(sha256.Size+10), d.Len(), d.Used())
+	}
+
+	// entries survive a restart, unfinished writes and broken files don't
+	ioutil.WriteFile(filepath.Join(dir, TMP_PREFIX+"x"), []byte("x"), 0644)
+
+	name := d.name("c")
+	ioutil.WriteFile(d.path(name), append(make([]byte, sha256.Size), 'x'), 0644)
+
+	if d, err = NewDisk(dir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, found := d.Get("a"); !found || string(b) != "aaaaaaaaaa" {
+		t.Errorf("Expected 'aaaaaaaaaa' after restart, got '%s', %v\n", b, found)
+	}
+
+	if _, found := d.Get("c"); found {
+		t.Errorf("Expected broken 'c' is not returned\n")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, TMP_PREFIX+"x")); !os.IsNotExist(err) {
+		t.Errorf("Expected temporary file is removed, got %v\n", err)
+	}
+
+	if d.Len() != 1 {
+		t.Errorf("Expected 1 entry, got %v\n", d.Len())
+	}
+}
@@ -0,0 +1,230 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const TMP_PREFIX = ".tmp-"
+
+// Disk is a persistent LRU cache of blobs within a size budget. Every file is a sha256
+// checksum of the data followed by the data, broken files are removed on read.
+type Disk struct {
+	sync.Mutex
+	dir     string
+	size    int64
+	used    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type diskEntry struct {
+	name string
+	size int64
+}
+
+// NewDisk creates dir if it's needed and picks up files, which are already there,
+// the least recently used files are evicted to fit the size.
+func NewDisk(dir string, size int64) (*Disk, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	this := &Disk{
+		dir:     dir,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+
+	var found []os.FileInfo
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		if strings.HasPrefix(info.Name(), TMP_PREFIX) {
+			// unfinished write of a previous run
+			os.Remove(path)
+			return nil
+		}
+
+		// files of other naming are not ours
+		if len(info.Name()) == 2*sha1.Size && filepath.Base(filepath.Dir(path)) == info.Name()[:2] {
+			found = append(found, info)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].ModTime().Before(found[j].ModTime()) })
+
+	this.Lock()
+	defer this.Unlock()
+
+	for _, info := range found {
+		this.push(info.Name(), info.Size())
+	}
+
+	this.evict()
+
+	return this, nil
+}
+
+// Get returns data for key, if it's cached and its checksum is valid.
+func (this *Disk) Get(key string) ([]byte, bool) {
+	name := this.name(key)
+
+	this.Lock()
+	el, found := this.entries[name]
+	if found {
+		this.lru.MoveToFront(el)
+	}
+	this.Unlock()
+
+	if !found {
+		return nil, false
+	}
+
+	b, err := ioutil.ReadFile(this.path(name))
+	if err != nil || len(b) < sha256.Size {
+		this.drop(name)
+		return nil, false
+	}
+
+	sum := sha256.Sum256(b[sha256.Size:])
+	if !bytes.Equal(sum[:], b[:sha256.Size]) {
+		log.Printf("Disk cache entry %v is broken, removing.\n", name)
+		this.drop(name)
+		return nil, false
+	}
+
+	// keeps LRU order across restarts
+	now := time.Now()
+	os.Chtimes(this.path(name), now, now)
+
+	return b[sha256.Size:], true
+}
+
+// Add writes data to a temporary file and renames it, so readers never see a partial file.
+func (this *Disk) Add(key string, data []byte) error {
+	size := int64(sha256.Size + len(data))
+	if size > this.size {
+		return nil
+	}
+
+	name := this.name(key)
+
+	if err := os.MkdirAll(filepath.Dir(this.path(name)), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(this.path(name)), TMP_PREFIX)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(data)
+
+	_, err = tmp.Write(append(sum[:], data...))
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), this.path(name))
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	if el, found := this.entries[name]; found {
+		this.remove(el)
+	}
+
+	this.push(name, size)
+	this.evict()
+
+	return nil
+}
+
+func (this *Disk) Len() int {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.lru.Len()
+}
+
+// Used returns bytes used by cached files.
+func (this *Disk) Used() int64 {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.used
+}
+
+// name is a sha1 of key, files are spread over 256 subdirectories by its first byte.
+func (this *Disk) name(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (this *Disk) path(name string) string {
+	return filepath.Join(this.dir, name[:2], name)
+}
+
+func (this *Disk) push(name string, size int64) {
+	this.entries[name] = this.lru.PushFront(&diskEntry{name: name, size: size})
+	this.used += size
+}
+
+func (this *Disk) evict() {
+	for this.used > this.size && this.lru.Len() > 0 {
+		el := this.lru.Back()
+		this.remove(el)
+		os.Remove(this.path(el.Value.(*diskEntry).name))
+	}
+}
+
+func (this *Disk) drop(name string) {
+	this.Lock()
+	defer this.Unlock()
+
+	if el, found := this.entries[name]; found {
+		this.remove(el)
+	}
+
+	os.Remove(this.path(name))
+}
+
+func (this *Disk) remove(el *list.Element) {
+	entry := el.Value.(*diskEntry)
+
+	delete(this.entries, entry.name)
+	this.lru.Remove(el)
+	this.used -= entry.size
+}
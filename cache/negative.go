@@ -0,0 +1,83 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Negative remembers failed keys for a short time, so a broken source,
+// which is requested often, doesn't hit the origin on every request.
+type Negative struct {
+	sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type negativeEntry struct {
+	key     string
+	err     error
+	expires time.Time
+}
+
+func NewNegative(size int, ttl time.Duration) *Negative {
+	return &Negative{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Get returns remembered error for key or nil.
+func (this *Negative) Get(key string) error {
+	this.Lock()
+	defer this.Unlock()
+
+	el, found := this.entries[key]
+	if !found {
+		return nil
+	}
+
+	entry := el.Value.(*negativeEntry)
+
+	if time.Now().After(entry.expires) {
+		this.remove(el)
+		return nil
+	}
+
+	return entry.err
+}
+
+func (this *Negative) Add(key string, err error) {
+	if this.size <= 0 || this.ttl <= 0 {
+		return
+	}
+
+	this.Lock()
+	defer this.Unlock()
+
+	if el, found := this.entries[key]; found {
+		this.remove(el)
+	}
+
+	this.entries[key] = this.lru.PushFront(&negativeEntry{key: key, err: err, expires: time.Now().Add(this.ttl)})
+
+	for this.lru.Len() > this.size {
+		this.remove(this.lru.Back())
+	}
+}
+
+func (this *Negative) Len() int {
+	this.Lock()
+	defer this.Unlock()
+
+	return this.lru.Len()
+}
+
+func (this *Negative) remove(el *list.Element) {
+	delete(this.entries, el.Value.(*negativeEntry).key)
+	this.lru.Remove(el)
+}
@@ -6,7 +6,9 @@ import (
 	"io/ioutil"
 	"log"
 	"regexp"
+	"runtime"
 	"strconv"
+	"time"
 )
 
 const (
@@ -15,65 +17,186 @@ const (
 	METHOD     = 3
 	QUALITY    = 80
 	ALPHA      = 0.5
+	BACKGROUND = "ffffff"
 	LISTEN_ON  = "127.0.0.1:15900"
 	CACHE_SELF = "http://127.0.0.1:9100"
+	MAX_AGE    = 86400
+
+	SOURCE_CACHE_SIZE = int64(256)
+	DISK_CACHE_SIZE   = int64(1024)
+
+	CONNECT_TIMEOUT = 5 * time.Second
+	READ_TIMEOUT    = 30 * time.Second
+	MAX_SOURCE_SIZE = int64(32) << 20
+
+	QUEUE_SIZE    = 64
+	QUEUE_TIMEOUT = 10 * time.Second
+
+	MAX_PIXELS = int64(50000000)
+	MAX_WIDTH  = 8192
+	MAX_HEIGHT = 8192
+
+	NEGATIVE_SIZE = 10000
+	NEGATIVE_TTL  = 5 * time.Second
 )
 
 var defaultCfg string = `
 {
     "listen" : "127.0.0.1:15900",
 
+    "max_age" : 86400,
+
     "defaults" : {
         "format"  : "jpeg",
         "method"  : 3,
         "quality" : 80,
-        "alpha"   : 0.5
+        "alpha"   : 0.5,
+
+        "background" : "ffffff",
+        "no_upscale" : false
     },
 
     "source" : {
         "http" : {
             "root"    : "",
-            "default" : true
+            "default" : true,
+
+            "connect_timeout" : "5s",
+            "read_timeout"    : "30s",
+            "max_size"        : "32M"
         },
 
         "file" : {
             "root"   : "",
-            "defaut" : false
+            "defaut" : false,
+
+            "max_size" : "32M"
         }
     },
 
+    "workers" : {
+        "size"    : 0,
+        "queue"   : 64,
+        "timeout" : "10s"
+    },
+
+    "limits" : {
+        "max_pixels" : 50000000,
+        "max_width"  : 8192,
+        "max_height" : 8192
+    },
+
+    "signature" : {
+        "keys" : []
+    },
+
     "groupcache" : {
         "self"  : "http://127.0.0.1:9100",
         "peers" : [],
-        "size"  : "512M"
+        "size"  : "512M",
+
+        "source_size" : "256M",
+
+        "disk" : {
+            "dir"  : "",
+            "size" : "1G"
+        },
+
+        "negative" : {
+            "size" : 10000,
+            "ttl"  : "5s"
+        }
     }
 }
 `
 
+// Networks, which are denied for http sources, if `deny` isn't configured.
+var DENY = []string{
+	"localhost",
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16",
+	"::/128", "::1/128", "fc00::/7", "fe80::/10",
+}
+
 type Source struct {
 	Root    string `json:"root"`
 	Default bool   `json:"default"`
+
+	// Hosts and networks (CIDR), which are allowed or denied as origins.
+	// Empty allow list means any host, which isn't denied.
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+
+	// Connection and the whole response timeouts, e.g. "5s". Are used by http source.
+	ConnectTimeout string `json:"connect_timeout"`
+	ReadTimeout    string `json:"read_timeout"`
+
+	// Maximum source size, e.g. "32M".
+	MaxSize string `json:"max_size"`
 }
 
 type Config struct {
 	ListenOn string `json:"listen"`
 
+	// Cache-Control max-age in seconds for image responses.
+	// Negative value disables client caching.
+	CacheMaxAge int `json:"max_age"`
+
 	Sources struct {
 		Http Source `json:"http"`
 		File Source `json:"file"`
 	} `json:"source"`
 
 	Defaults struct {
-		Format  string  `json:"format"`
-		Method  int     `json:"method"`
-		Quality int     `json:"quality"`
-		Alpha   float64 `json:"blend_alpha"`
+		Format     string  `json:"format"`
+		Method     int     `json:"method"`
+		Quality    int     `json:"quality"`
+		Alpha      float64 `json:"blend_alpha"`
+		Background string  `json:"background"`
+
+		// Results aren't bigger than sources, unless `enlarge=true` is requested.
+		NoUpscale bool `json:"no_upscale"`
 	} `json:"defaults"`
 
+	// Image processing concurrency. Size is a count of concurrent transformations, default is CPU count,
+	// queue is a count of requests, which could wait for a worker not longer than timeout.
+	Workers struct {
+		Size    int    `json:"size"`
+		Queue   int    `json:"queue"`
+		Timeout string `json:"timeout"`
+	} `json:"workers"`
+
+	// Source images with more pixels and results with bigger dimensions are rejected.
+	Limits struct {
+		MaxPixels int64 `json:"max_pixels"`
+		MaxWidth  int   `json:"max_width"`
+		MaxHeight int   `json:"max_height"`
+	} `json:"limits"`
+
+	// If keys are defined, every request should be signed with one of them.
+	// The first key is used to sign, the rest are accepted for rotation.
+	Signature struct {
+		Keys []string `json:"keys"`
+	} `json:"signature"`
+
 	GroupCache struct {
 		Self  string   `json:"self"`
 		Peers []string `json:"peers"`
 		Size  string   `json:"size"`
+
+		// Size of a separate group for original source images.
+		SourceSize string `json:"source_size"`
+
+		// Optional persistent tier for results, it's disabled if dir is empty.
+		Disk struct {
+			Dir  string `json:"dir"`
+			Size string `json:"size"`
+		} `json:"disk"`
+
+		// Short-lived cache of failed transformations.
+		Negative struct {
+			Size int    `json:"size"`
+			Ttl  string `json:"ttl"`
+		} `json:"negative"`
 	} `json:"groupcache"`
 
 	Blend struct {
@@ -128,6 +251,62 @@ func (this *Config) Listen() string {
 	return this.ListenOn
 }
 
+func (this *Config) MaxAge() int {
+	if this.CacheMaxAge == 0 {
+		return MAX_AGE
+	}
+
+	return this.CacheMaxAge
+}
+
+func (this *Config) WorkersSize() int {
+	if this.Workers.Size == 0 {
+		return runtime.NumCPU()
+	}
+
+	return this.Workers.Size
+}
+
+func (this *Config) QueueSize() int {
+	if this.Workers.Queue == 0 {
+		return QUEUE_SIZE
+	}
+
+	return this.Workers.Queue
+}
+
+func (this *Config) QueueTimeout() time.Duration {
+	return duration(this.Workers.Timeout, QUEUE_TIMEOUT)
+}
+
+func (this *Config) MaxPixels() int64 {
+	if this.Limits.MaxPixels == 0 {
+		return MAX_PIXELS
+	}
+
+	return this.Limits.MaxPixels
+}
+
+func (this *Config) MaxWidth() int {
+	if this.Limits.MaxWidth == 0 {
+		return MAX_WIDTH
+	}
+
+	return this.Limits.MaxWidth
+}
+
+func (this *Config) MaxHeight() int {
+	if this.Limits.MaxHeight == 0 {
+		return MAX_HEIGHT
+	}
+
+	return this.Limits.MaxHeight
+}
+
+func (this *Config) SignatureKeys() []string {
+	return this.Signature.Keys
+}
+
 func (this *Config) Scheme() string {
 	if this.Sources.File.Default {
 		return "file"
@@ -159,6 +338,40 @@ func (this *Config) RootHttp() (string, error) {
 	return this.Sources.Http.Root, nil
 }
 
+func (this *Config) HttpAllow() []string {
+	return this.Sources.Http.Allow
+}
+
+// HttpDeny returns configured deny list, or default one, if it isn't defined.
+// Use an empty list to allow everything.
+func (this *Config) HttpDeny() []string {
+	if this.Sources.Http.Deny == nil {
+		return DENY
+	}
+
+	return this.Sources.Http.Deny
+}
+
+func (this *Config) Source(scheme string) *Source {
+	if scheme == "file" {
+		return &this.Sources.File
+	}
+
+	return &this.Sources.Http
+}
+
+func (this *Config) ConnectTimeout(scheme string) time.Duration {
+	return duration(this.Source(scheme).ConnectTimeout, CONNECT_TIMEOUT)
+}
+
+func (this *Config) ReadTimeout(scheme string) time.Duration {
+	return duration(this.Source(scheme).ReadTimeout, READ_TIMEOUT)
+}
+
+func (this *Config) MaxSourceSize(scheme string) int64 {
+	return size(this.Source(scheme).MaxSize, MAX_SOURCE_SIZE)
+}
+
 func (this *Config) RootFile() (string, error) {
 	r := []rune(this.Sources.File.Root)
 	if len(r) == 0 {
@@ -187,32 +400,31 @@ func (this *Config) CachePeers() []string {
 }
 
 func (this *Config) CacheSize() int64 {
-	if this.GroupCache.Size == "" {
-		return CACHE_SIZE << 20
-	}
+	return size(this.GroupCache.Size, CACHE_SIZE<<20)
+}
 
-	r := regexp.MustCompile("([0-9]+)(M|G)")
-	result := r.FindStringSubmatch(this.GroupCache.Size)
-	if len(result) != 3 {
-		log.Printf("Wrong size value '%v', using default.\n", result[2])
-		return CACHE_SIZE << 20
-	}
+func (this *Config) SourceCacheSize() int64 {
+	return size(this.GroupCache.SourceSize, SOURCE_CACHE_SIZE<<20)
+}
 
-	val, err := strconv.Atoi(result[1])
-	if err != nil {
-		log.Printf("Wrong size value '%v'. %v\n", result[1], err)
-		return CACHE_SIZE << 20
-	}
+func (this *Config) DiskCacheDir() string {
+	return this.GroupCache.Disk.Dir
+}
 
-	if result[2] == "G" {
-		return int64(val) << 30
-	}
+func (this *Config) DiskCacheSize() int64 {
+	return size(this.GroupCache.Disk.Size, DISK_CACHE_SIZE<<20)
+}
 
-	if result[2] == "M" {
-		return int64(val) << 20
+func (this *Config) NegativeSize() int {
+	if this.GroupCache.Negative.Size == 0 {
+		return NEGATIVE_SIZE
 	}
 
-	return CACHE_SIZE << 20
+	return this.GroupCache.Negative.Size
+}
+
+func (this *Config) NegativeTtl() time.Duration {
+	return duration(this.GroupCache.Negative.Ttl, NEGATIVE_TTL)
 }
 
 func (this *Config) Format() string {
@@ -247,6 +459,24 @@ func (this *Config) Alpha() float64 {
 	return this.Defaults.Alpha
 }
 
+// Background returns s, if it's given, or the default background color.
+func (this *Config) Background(s string) string {
+	if s != "" {
+		return s
+	}
+
+	if this.Defaults.Background == "" {
+		return BACKGROUND
+	}
+
+	return this.Defaults.Background
+}
+
+// Enlarge is a default of `enlarge` option.
+func (this *Config) Enlarge() bool {
+	return !this.Defaults.NoUpscale
+}
+
 func (this *Config) BlendWith(s string) string {
 	if s != "" {
 		return s
@@ -270,3 +500,47 @@ func (this *Config) BlendRoi(s string) string {
 
 	return this.Blend.Roi
 }
+
+func duration(s string, def time.Duration) time.Duration {
+	if s == "" {
+		return def
+	}
+
+	val, err := time.ParseDuration(s)
+	if err != nil {
+		log.Printf("Wrong duration value '%v', using default. %v\n", s, err)
+		return def
+	}
+
+	return val
+}
+
+// size parses values like `512K`, `512M` or `1G`.
+func size(s string, def int64) int64 {
+	if s == "" {
+		return def
+	}
+
+	r := regexp.MustCompile("^([0-9]+)(K|M|G)$")
+	result := r.FindStringSubmatch(s)
+	if len(result) != 3 {
+		log.Printf("Wrong size value '%v', using default.\n", s)
+		return def
+	}
+
+	val, err := strconv.ParseInt(result[1], 10, 64)
+	if err != nil {
+		log.Printf("Wrong size value '%v'. %v\n", result[1], err)
+		return def
+	}
+
+	switch result[2] {
+	case "K":
+		return val << 10
+
+	case "M":
+		return val << 20
+	}
+
+	return val << 30
+}
@@ -4,7 +4,9 @@ import (
 	"io/ioutil"
 	"os"
 	"reflect"
+	"runtime"
 	"testing"
+	"time"
 )
 
 func TestDefaults(t *testing.T) {
@@ -29,6 +31,46 @@ func TestDefaults(t *testing.T) {
 	if Get().Quality() != QUALITY {
 		t.Errorf("Expected quality is %v, got %v\n", QUALITY, Get().Quality())
 	}
+
+	if Get().Background("") != BACKGROUND || Get().Background("000") != "000" {
+		t.Errorf("Expected background is %v, got %v\n", BACKGROUND, Get().Background(""))
+	}
+
+	if !Get().Enlarge() {
+		t.Errorf("Expected enlarge is enabled by default\n")
+	}
+
+	if Get().SourceCacheSize() != SOURCE_CACHE_SIZE<<20 {
+		t.Errorf("Expected source cache size is %v, got %v\n", SOURCE_CACHE_SIZE<<20, Get().SourceCacheSize())
+	}
+
+	if Get().DiskCacheDir() != "" || Get().DiskCacheSize() != DISK_CACHE_SIZE<<20 {
+		t.Errorf("Expected disk cache is disabled with size %v, got '%v', %v\n", DISK_CACHE_SIZE<<20, Get().DiskCacheDir(), Get().DiskCacheSize())
+	}
+
+	if Get().MaxAge() != MAX_AGE {
+		t.Errorf("Expected max age is %v, got %v\n", MAX_AGE, Get().MaxAge())
+	}
+
+	if Get().NegativeSize() != NEGATIVE_SIZE || Get().NegativeTtl() != NEGATIVE_TTL {
+		t.Errorf("Expected negative cache %v, %v, got %v, %v\n", NEGATIVE_SIZE, NEGATIVE_TTL, Get().NegativeSize(), Get().NegativeTtl())
+	}
+
+	if Get().ConnectTimeout("http") != CONNECT_TIMEOUT || Get().ReadTimeout("http") != READ_TIMEOUT {
+		t.Errorf("Expected timeouts %v, %v, got %v, %v\n", CONNECT_TIMEOUT, READ_TIMEOUT, Get().ConnectTimeout("http"), Get().ReadTimeout("http"))
+	}
+
+	if Get().MaxSourceSize("file") != MAX_SOURCE_SIZE {
+		t.Errorf("Expected max source size is %v, got %v\n", MAX_SOURCE_SIZE, Get().MaxSourceSize("file"))
+	}
+
+	if Get().WorkersSize() != runtime.NumCPU() || Get().QueueSize() != QUEUE_SIZE || Get().QueueTimeout() != QUEUE_TIMEOUT {
+		t.Errorf("Expected workers %v, %v, %v, got %v, %v, %v\n", runtime.NumCPU(), QUEUE_SIZE, QUEUE_TIMEOUT, Get().WorkersSize(), Get().QueueSize(), Get().QueueTimeout())
+	}
+
+	if Get().MaxPixels() != MAX_PIXELS || Get().MaxWidth() != MAX_WIDTH || Get().MaxHeight() != MAX_HEIGHT {
+		t.Errorf("Expected limits %v, %v, %v, got %v, %v, %v\n", MAX_PIXELS, MAX_WIDTH, MAX_HEIGHT, Get().MaxPixels(), Get().MaxWidth(), Get().MaxHeight())
+	}
 }
 
 func TestEmbedJson(t *testing.T) {
@@ -69,13 +111,18 @@ func TestFileConf(t *testing.T) {
         "defaults" : {
             "format"  : "png",
             "method"  : 4,
-            "quality" : 80
+            "quality" : 80,
+
+            "no_upscale" : true
         },
 
         "source" : {
             "http" : {
                 "root"    : "",
-                "default" : true
+                "default" : true,
+
+                "connect_timeout" : "1s",
+                "max_size"        : "512K"
             },
 
             "file" : {
@@ -93,7 +140,19 @@ func TestFileConf(t *testing.T) {
                 "http://cache03.local:8000"
             ],
 
-            "size"  :  "1G"
+            "size"  :  "1G",
+
+            "source_size" : "64M",
+
+            "disk" : {
+                "dir"  : "/var/cache/imagio",
+                "size" : "10G"
+            },
+
+            "negative" : {
+                "size" : 100,
+                "ttl"  : "1m"
+            }
         }
     }`
 
@@ -114,14 +173,38 @@ func TestFileConf(t *testing.T) {
 		t.Errorf("Expected method is png, got %v\n", Get().Format())
 	}
 
+	if Get().Enlarge() {
+		t.Errorf("Expected enlarge is disabled by no_upscale\n")
+	}
+
 	if Get().CacheSize() != 1<<30 {
 		t.Errorf("Expected cache size is %v, got %v\n", 1<<30, Get().CacheSize())
 	}
 
+	if Get().SourceCacheSize() != 64<<20 {
+		t.Errorf("Expected source cache size is %v, got %v\n", 64<<20, Get().SourceCacheSize())
+	}
+
+	if Get().DiskCacheDir() != "/var/cache/imagio" || Get().DiskCacheSize() != 10<<30 {
+		t.Errorf("Expected disk cache /var/cache/imagio, %v, got '%v', %v\n", 10<<30, Get().DiskCacheDir(), Get().DiskCacheSize())
+	}
+
 	if Get().CacheSelf() != "http://127.0.0.1:8000" {
 		t.Errorf("Expected self option is 'http://127.0.0.1:8000', got %v\n", Get().CacheSelf())
 	}
 
+	if Get().ConnectTimeout("http") != time.Second || Get().ReadTimeout("http") != READ_TIMEOUT {
+		t.Errorf("Expected timeouts 1s, %v, got %v, %v\n", READ_TIMEOUT, Get().ConnectTimeout("http"), Get().ReadTimeout("http"))
+	}
+
+	if Get().MaxSourceSize("http") != 512<<10 || Get().MaxSourceSize("file") != MAX_SOURCE_SIZE {
+		t.Errorf("Expected max source sizes 512K, %v, got %v, %v\n", MAX_SOURCE_SIZE, Get().MaxSourceSize("http"), Get().MaxSourceSize("file"))
+	}
+
+	if Get().NegativeSize() != 100 || Get().NegativeTtl() != time.Minute {
+		t.Errorf("Expected negative cache 100, 1m, got %v, %v\n", Get().NegativeSize(), Get().NegativeTtl())
+	}
+
 	peers := []string{"http://cache01.local:8000", "http://cache02.local:8000", "http://cache03.local:8000", "http://127.0.0.1:8000"}
 	if !reflect.DeepEqual(peers, Get().CachePeers()) {
 		t.Errorf("Expected peers option is %v, got %v\n", peers, Get().CachePeers())
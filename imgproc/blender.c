@@ -66,8 +66,6 @@ IplImage *addWeighted(IplImage *base, IplImage *fg, float alpha, CvRect *roi) {
 }
 
 Blob *blender(const Blob *base, const Blob *foreground, const Blob *mask, const int quality, const char *format, const float alpha, CvRect *roi) {
-    int p[3] = {CV_IMWRITE_JPEG_QUALITY, quality, 0};
-
     cvUseOptimized(1);
 
     // init base
@@ -86,6 +84,15 @@ Blob *blender(const Blob *base, const Blob *foreground, const Blob *mask, const
     IplImage *fgImg = cvDecodeImage(fgBuf, CV_LOAD_IMAGE_UNCHANGED);
     cvReleaseMat(&fgBuf);
 
+    if(!baseMat || !baseImg || !fgMat || !fgImg) {
+        fprintf(stderr, "blender.c: cvDecodeImage() error.\n");
+        cvReleaseMat(&baseMat);
+        cvReleaseMat(&fgMat);
+        cvReleaseImage(&baseImg);
+        cvReleaseImage(&fgImg);
+        return NULL;
+    }
+
     // init mask
     CvMat *maskMat, *maskBuf = NULL;
     IplImage *maskImg = NULL;
@@ -104,11 +111,11 @@ Blob *blender(const Blob *base, const Blob *foreground, const Blob *mask, const
 
     if(fgImg->nChannels <= 3 && !mask) {
         IplImage *tmp = addWeighted(baseImg, fgImg, alpha, roi);    
-        result = cvEncodeImage(format, tmp, p);
+        result = encodeImage(format, tmp, quality);
         cvReleaseImage(&tmp);
     } else {
         CvMat *tmp = overlayImage(baseMat, baseImg, fgMat, fgImg, maskMat, roi);    
-        result = cvEncodeImage(format, tmp, p);
+        result = encodeImage(format, tmp, quality);
         cvReleaseMat(&tmp);
     }
 
@@ -122,6 +129,11 @@ Blob *blender(const Blob *base, const Blob *foreground, const Blob *mask, const
     cvReleaseImage(&baseImg);
     cvReleaseImage(&fgImg);
 
+    if(!result) {
+        fprintf(stderr, "blender.c: cvEncodeImage() error.\n");
+        return NULL;
+    }
+
     Blob *out = malloc(sizeof(Blob));
     out->data = malloc(result->step);
     out->length = result->step;
@@ -3,7 +3,9 @@
 
 #include <highgui.h>
 #include <cv.h>
+#include <math.h>
 #include <stdio.h>
+#include <string.h>
 #include <strings.h>
 #include <stdlib.h>
 #include <stdint.h>
@@ -18,7 +20,16 @@ typedef struct {
     unsigned int length;    
 } Blob;
 
-Blob *resizer(Blob *in, PixelDim *zoom, int quality, int method, const char *format, CvRect *roi);
+// Transformations, which are applied right after decoding, in this order.
+typedef struct {
+    int orientation;    // EXIF orientation from 1 to 8
+    double angle;       // clockwise rotation in degrees
+    CvScalar fill;      // color of corners for arbitrary angles and of padding
+    int flip;           // 1 horizontal, 2 vertical, 3 both
+} Transform;
+
+CvMat *encodeImage(const char *format, const CvArr *img, int quality);
+Blob *resizer(Blob *in, PixelDim *zoom, int quality, int method, const char *format, CvRect *roi, int alpha, CvScalar *bg, Transform *t, CvRect *pad);
 Blob *blender(const Blob *bg, const Blob *fg, const Blob *mask, int quality, const char *format, const float alpha, CvRect *roi);
 
 #endif
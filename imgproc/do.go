@@ -7,92 +7,177 @@ package imgproc
 import "C"
 
 import (
+	"context"
 	. "github.com/3d0c/imagio/query"
+	"github.com/3d0c/imagio/stat"
 	. "github.com/3d0c/imagio/utils"
 	"log"
+	"net/http"
+	"time"
 	"unsafe"
 )
 
-type Blob _Ctype_Blob
-type CvRect _Ctype_CvRect
+// OpenCV encodes webp losslessly, if quality is above 100.
+const WEBP_LOSSLESS = 101
+
+type Blob C.Blob
+type CvRect C.CvRect
+
+// Do fetches sources and transforms them, ctx cancels waiting for a worker.
+func Do(ctx context.Context, o *Options) ([]byte, error) {
+	// sources are fetched before getting a worker, workers are for processing only
+	if err := o.Load(); err != nil {
+		return nil, err
+	}
+
+	if err := getPool().acquire(ctx); err != nil {
+		return nil, err
+	}
+
+	defer getPool().release()
+	defer stat.Processing.Since(time.Now())
+
+	if isGif(o) {
+		return gifActions(o)
+	}
 
-func Do(o *Options) []byte {
 	return Filters(PrimaryActions(o))
 }
 
-func PrimaryActions(o *Options) (*Options, []byte) {
+func PrimaryActions(o *Options) (*Options, []byte, error) {
 	if o.Base == nil {
-		return o, nil
+		return o, nil, NewError(http.StatusBadRequest, "Option `source` is required.")
 	}
 
-	if o.CropRoi != nil && o.Scale != nil {
-		// if both options selected, crop will be first, the scale size will be calculated from cropped dimension
-		roi := o.CropRoi.Calc(o.Base.Size())
-		zoom := o.Scale.Size(&PixelDim{roi.Width, roi.Height})
-
-		return o, resize(o, zoom, roi)
+	if err := o.Load(); err != nil {
+		return o, nil, err
 	}
 
-	if o.CropRoi != nil {
-		return o, resize(o, nil, o.CropRoi.Calc(o.Base.Size()))
+	if o.Format == "json" {
+		data, err := meta(o)
+		return o, data, err
 	}
 
-	if o.Scale != nil {
-		return o, resize(o, o.Scale.Size(o.Base.Size()), nil)
+	zoom, roi, err := o.Geometry()
+	if err != nil {
+		return o, nil, err
 	}
 
-	return o, resize(o, o.Base.Size(), nil)
+	data, err := resize(o, zoom, roi)
+	return o, data, err
 }
 
-func Filters(o *Options, b []byte) []byte {
-	if b == nil {
-		return nil
+func Filters(o *Options, b []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
 	}
 
-	if o.Foreground != nil {
+	if o.Foreground != nil && o.Format != "json" {
+		base := Construct(new(Source), b).(*Source)
+		if base == nil {
+			return nil, NewError(http.StatusUnprocessableEntity, "Unable to blend, resized image is broken.")
+		}
+
+		// shortcuts and percentages are related to the image, the foreground is blended with
 		var roi *Rect = nil
 		if o.BlendRoi != nil {
-			roi = o.BlendRoi.Calc(o.Base.Size())
+			roi = o.BlendRoi.Calc(base.Size())
 		}
 
-		return blend(Construct(new(Source), b).(*Source), o, roi)
+		return blend(base, o, roi)
 	}
 
-	return b
+	return b, nil
 }
 
-func resize(o *Options, zoom *PixelDim, roi *Rect) []byte {
+func resize(o *Options, zoom *PixelDim, roi *Rect) ([]byte, error) {
 	var data []byte
 
+	cvroi := initCvRect(roi)
+
+	if zoom == nil && cvroi == nil {
+		return nil, NewError(http.StatusUnprocessableEntity, "Unable to calculate result dimensions for %v.", o.Base.Key())
+	}
+
+	format := C.CString("." + o.Format)
+	defer C.free(unsafe.Pointer(format))
+
+	var alpha C.int
+	var bg *C.CvScalar
+
+	// without a background alpha channel is dropped for formats, which don't support it
+	if o.Base.HasAlpha() && (!o.Flatten() || o.Background != nil) {
+		alpha = 1
+
+		if o.Flatten() {
+			bg = &C.CvScalar{}
+			// OpenCV keeps channels in BGR order
+			bg.val[0], bg.val[1], bg.val[2] = C.double(o.Background.B), C.double(o.Background.G), C.double(o.Background.R)
+		}
+	}
+
+	t := &C.Transform{
+		orientation: C.int(o.Base.Orientation()),
+		angle:       C.double(o.Rotate),
+		flip:        C.int(o.Flip),
+	}
+
+	if o.Fill != nil {
+		t.fill.val[0], t.fill.val[1], t.fill.val[2], t.fill.val[3] = C.double(o.Fill.B), C.double(o.Fill.G), C.double(o.Fill.R), 255
+	}
+
+	// position and size of the result box for `contain` fit
+	var pad *CvRect
+
+	if canvas := o.Canvas(zoom); canvas != nil {
+		pad = &CvRect{C.int(canvas.X), C.int(canvas.Y), C.int(canvas.Width), C.int(canvas.Height)}
+	}
+
+	defer stat.CgoDuration.Since(time.Now(), "resize")
+
 	result := C.resizer(
 		(*C.Blob)(unsafe.Pointer(blobptr(o.Base))),
 		(*C.PixelDim)(unsafe.Pointer(zoom)),
-		C.int(o.Quality), C.int(o.Method), C.CString("."+o.Format),
-		(*C.CvRect)(initCvRect(roi)),
+		C.int(quality(o)), C.int(o.Method), format,
+		(*C.CvRect)(cvroi),
+		alpha, bg, t, (*C.CvRect)(pad),
 	)
 
-	if result != nil {
-		length := result.length
-		data = C.GoBytes(unsafe.Pointer(result.data), C.int(length))
+	if result == nil {
+		return nil, NewError(http.StatusUnprocessableEntity, "Unable to process image from %v.", o.Base.Key())
+	}
+
+	length := result.length
+	data = C.GoBytes(unsafe.Pointer(result.data), C.int(length))
+
+	C.free(unsafe.Pointer(result.data))
+	C.free(unsafe.Pointer(result))
 
-		C.free(unsafe.Pointer(result.data))
-		C.free(unsafe.Pointer(result))
+	return data, nil
+}
+
+func quality(o *Options) int {
+	if o.Lossless && o.Format == "webp" {
+		return WEBP_LOSSLESS
 	}
 
-	return (data)
+	return o.Quality
 }
 
-func blend(base *Source, o *Options, roi *Rect) []byte {
+func blend(base *Source, o *Options, roi *Rect) ([]byte, error) {
 	var data []byte
 	rect := &CvRect{0, 0, 0, 0}
 
 	if roi != nil {
-		if w := (roi.X + o.Foreground.Size().Width); w > base.Size().Width {
+		// blender doesn't apply EXIF orientation to the foreground, so it's checked as it's stored
+		fg := o.Foreground.Config()
+
+		if w := (roi.X + fg.Width); w > base.Size().Width {
 			log.Printf("Wrong blend_roi: width %d > %d. Using (x = 0).\n", w, base.Size().Width)
 			roi.X = 0
 		}
 
-		if h := (roi.Y + o.Foreground.Size().Height); h > base.Size().Height {
+		if h := (roi.Y + fg.Height); h > base.Size().Height {
 			log.Printf("Wrong blend_roi: height %d > %d. Using (y = 0).\n", h, base.Size().Height)
 			roi.Y = 0
 		}
@@ -100,23 +185,30 @@ func blend(base *Source, o *Options, roi *Rect) []byte {
 		rect = &CvRect{C.int(roi.X), C.int(roi.Y), C.int(roi.Width), C.int(roi.Height)}
 	}
 
+	format := C.CString("." + o.Format)
+	defer C.free(unsafe.Pointer(format))
+
+	defer stat.CgoDuration.Since(time.Now(), "blend")
+
 	result := C.blender(
 		(*C.Blob)(blobptr(base)),
 		(*C.Blob)(blobptr(o.Foreground)),
 		(*C.Blob)(blobptr(o.Mask)),
-		C.int(o.Quality), C.CString("."+o.Format), C.float(o.Alpha),
+		C.int(quality(o)), format, C.float(o.Alpha),
 		(*C.CvRect)(rect),
 	)
 
-	if result != nil {
-		length := result.length
-		data = C.GoBytes(unsafe.Pointer(result.data), C.int(length))
-
-		C.free(unsafe.Pointer(result.data))
-		C.free(unsafe.Pointer(result))
+	if result == nil {
+		return nil, NewError(http.StatusUnprocessableEntity, "Unable to blend %v with %v.", o.Base.Key(), o.Foreground.Key())
 	}
 
-	return (data)
+	length := result.length
+	data = C.GoBytes(unsafe.Pointer(result.data), C.int(length))
+
+	C.free(unsafe.Pointer(result.data))
+	C.free(unsafe.Pointer(result))
+
+	return data, nil
 }
 
 func blobptr(s *Source) *Blob {
@@ -0,0 +1,12 @@
+#include "cv_handler.h"
+
+// Chooses encoding parameters by format. WebP quality above 100 means lossless encoding.
+CvMat *encodeImage(const char *format, const CvArr *img, int quality) {
+	int p[3] = {CV_IMWRITE_JPEG_QUALITY, quality, 0};
+
+	if(strcmp(format, ".webp") == 0) {
+		p[0] = CV_IMWRITE_WEBP_QUALITY;
+	}
+
+	return cvEncodeImage(format, img, p);
+}
@@ -0,0 +1,363 @@
+package imgproc
+
+import (
+	"bytes"
+	"errors"
+	"github.com/3d0c/imagio/config"
+	. "github.com/3d0c/imagio/query"
+	. "github.com/3d0c/imagio/utils"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"net/http"
+)
+
+// OpenCV can't decode and encode gif, so gif sources and gif results are processed frame by frame.
+// Every frame is composed on the canvas, converted to png and goes through the usual resize and blend,
+// then frames are quantized back, see framePalette.
+func isGif(o *Options) bool {
+	return o.Base != nil && o.Format != "json" && (o.Base.Type() == "gif" || o.Format == "gif")
+}
+
+func gifActions(o *Options) ([]byte, error) {
+	zoom, roi, err := o.Geometry()
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Base.Type() != "gif" {
+		// e.g. jpeg to gif, OpenCV produces png, which is converted to gif here
+		b, err := frame(o, o.Base.Blob(), "png", zoom, roi)
+		if err != nil {
+			return nil, err
+		}
+
+		return encodeGif(b, nil)
+	}
+
+	// frames are counted without decoding, so a gif of many small frames isn't decoded at all
+	count, err := countFrames(o.Base.Blob())
+	if err != nil {
+		return nil, NewError(http.StatusUnprocessableEntity, "Unable to decode gif from %v. %v", o.Base.Key(), err)
+	}
+
+	canvas := image.Rect(0, 0, o.Base.Size().Width, o.Base.Size().Height)
+
+	if pixels := int64(canvas.Dx()) * int64(canvas.Dy()) * int64(count); pixels > config.Get().MaxPixels() {
+		return nil, NewError(http.StatusRequestEntityTooLarge, "Resource %v has %d frames of %dx%d pixels, maximum is %d pixels.", o.Base.Key(), count, canvas.Dx(), canvas.Dy(), config.Get().MaxPixels())
+	}
+
+	src, err := gif.DecodeAll(bytes.NewReader(o.Base.Blob()))
+	if err != nil || len(src.Image) == 0 {
+		return nil, NewError(http.StatusUnprocessableEntity, "Unable to decode gif from %v. %v", o.Base.Key(), err)
+	}
+
+	frames, palettes := composeFrames(src, canvas)
+
+	if o.Format != "gif" {
+		return frame(o, frames[0], o.Format, zoom, roi)
+	}
+
+	if o.FirstFrame || len(frames) == 1 {
+		// OpenCV can't encode gif, the frame is produced as png and converted
+		b, err := frame(o, frames[0], "png", zoom, roi)
+		if err != nil {
+			return nil, err
+		}
+
+		return encodeGif(b, palettes[0])
+	}
+
+	result := &gif.GIF{LoopCount: src.LoopCount}
+
+	for i, blob := range frames {
+		b, err := frame(o, blob, "png", zoom, roi)
+		if err != nil {
+			return nil, err
+		}
+
+		img, err := png.Decode(bytes.NewReader(b))
+		if err != nil {
+			return nil, NewError(http.StatusUnprocessableEntity, "Unable to decode frame %d. %v", i, err)
+		}
+
+		p := palettes[i]
+		if p == nil {
+			p = defaultPalette(img)
+		}
+
+		result.Image = append(result.Image, paletted(img, p))
+		result.Delay = append(result.Delay, src.Delay[i])
+		// every frame is a whole canvas, which could have transparent pixels
+		result.Disposal = append(result.Disposal, gif.DisposalBackground)
+	}
+
+	result.Config = image.Config{Width: result.Image[0].Bounds().Dx(), Height: result.Image[0].Bounds().Dy()}
+
+	buf := new(bytes.Buffer)
+
+	if err := gif.EncodeAll(buf, result); err != nil {
+		return nil, NewError(http.StatusUnprocessableEntity, "Unable to encode gif. %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// countFrames walks gif blocks and counts image descriptors, image data is skipped, not decoded.
+func countFrames(b []byte) (int, error) {
+	errFormat := errors.New("gif: invalid format")
+
+	if len(b) < 13 || (string(b[:6]) != "GIF87a" && string(b[:6]) != "GIF89a") {
+		return 0, errFormat
+	}
+
+	i := 13
+
+	// global color table
+	if b[10]&0x80 != 0 {
+		i += 3 << (b[10]&0x07 + 1)
+	}
+
+	// skipBlocks skips data sub-blocks, which end with a zero length one
+	skipBlocks := func() bool {
+		for i < len(b) {
+			n := int(b[i])
+			i += 1 + n
+
+			if n == 0 {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	count := 0
+
+	for i < len(b) {
+		switch b[i] {
+		case 0x21:
+			// extension: introducer, label and data sub-blocks
+			i += 2
+			if !skipBlocks() {
+				return 0, errFormat
+			}
+
+		case 0x2c:
+			// image descriptor, optional local color table, LZW code size and image data
+			if i+10 > len(b) {
+				return 0, errFormat
+			}
+
+			flags := b[i+9]
+			i += 10
+
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+
+			i++
+			if !skipBlocks() {
+				return 0, errFormat
+			}
+
+			count++
+
+		case 0x3b:
+			// trailer
+			return count, nil
+
+		default:
+			return 0, errFormat
+		}
+	}
+
+	// some encoders omit the trailer
+	if count == 0 {
+		return 0, errFormat
+	}
+
+	return count, nil
+}
+
+// frame resizes and blends one image with options of the request and given format.
+func frame(o *Options, blob []byte, format string, zoom *PixelDim, roi *Rect) ([]byte, error) {
+	f := *o
+	f.Format = format
+
+	if f.Base = Construct(new(Source), blob).(*Source); f.Base == nil {
+		return nil, NewError(http.StatusUnprocessableEntity, "Unable to process frame of %v.", o.Base.Key())
+	}
+
+	b, err := resize(&f, zoom, roi)
+
+	return Filters(&f, b, err)
+}
+
+// composeFrames returns png and palette of every frame as it's seen, frames could be smaller
+// than the canvas and are disposed in different ways.
+func composeFrames(src *gif.GIF, canvas image.Rectangle) ([][]byte, []color.Palette) {
+	result := make([][]byte, 0, len(src.Image))
+	palettes := make([]color.Palette, 0, len(src.Image))
+	current := image.NewNRGBA(canvas)
+
+	for i, img := range src.Image {
+		var previous *image.NRGBA
+
+		disposal := byte(0)
+		if i < len(src.Disposal) {
+			disposal = src.Disposal[i]
+		}
+
+		if disposal == gif.DisposalPrevious {
+			previous = image.NewNRGBA(canvas)
+			copy(previous.Pix, current.Pix)
+		}
+
+		draw.Draw(current, img.Bounds(), img, img.Bounds().Min, draw.Over)
+
+		buf := new(bytes.Buffer)
+		png.Encode(buf, current)
+		result = append(result, buf.Bytes())
+		palettes = append(palettes, framePalette(src, current))
+
+		switch disposal {
+		case gif.DisposalBackground:
+			draw.Draw(current, img.Bounds(), image.Transparent, image.ZP, draw.Src)
+
+		case gif.DisposalPrevious:
+			current = previous
+		}
+	}
+
+	return result, palettes
+}
+
+// framePalette returns a palette for a composed frame. It keeps pixels of previous frames, so a local
+// palette of the frame doesn't fit it. Exact colors of the frame are used, if there are not more than 256,
+// then the global palette, nil if there is none.
+func framePalette(src *gif.GIF, img *image.NRGBA) color.Palette {
+	if p := colors(img); p != nil {
+		return p
+	}
+
+	p, _ := src.Config.ColorModel.(color.Palette)
+
+	// transparency is defined per frame, the global palette hasn't got a transparent color
+	if p != nil && !img.Opaque() && !hasTransparent(p) {
+		p = append(color.Palette{color.Transparent}, p...)
+
+		if len(p) > 256 {
+			p = p[:256]
+		}
+	}
+
+	return p
+}
+
+// colors returns all colors of img, or nil if there are more than 256.
+func colors(img *image.NRGBA) color.Palette {
+	seen := map[color.NRGBA]bool{}
+	p := color.Palette{}
+
+	for i := 0; i < len(img.Pix); i += 4 {
+		c := color.NRGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}
+		if c.A == 0 {
+			c = color.NRGBA{}
+		}
+
+		if seen[c] {
+			continue
+		}
+
+		if len(p) == 256 {
+			return nil
+		}
+
+		seen[c] = true
+		p = append(p, c)
+	}
+
+	return p
+}
+
+func hasTransparent(p color.Palette) bool {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// encodeGif converts png to a single frame gif. Without a source palette defaultPalette is used.
+func encodeGif(b []byte, p color.Palette) ([]byte, error) {
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, NewError(http.StatusUnprocessableEntity, "Unable to decode result. %v", err)
+	}
+
+	if p == nil {
+		p = defaultPalette(img)
+	}
+
+	buf := new(bytes.Buffer)
+
+	if err := gif.Encode(buf, paletted(img, p), nil); err != nil {
+		return nil, NewError(http.StatusUnprocessableEntity, "Unable to encode gif. %v", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// defaultPalette is Plan9, with a transparent color for images with alpha channel.
+func defaultPalette(img image.Image) color.Palette {
+	if opaque(img) {
+		return palette.Plan9
+	}
+
+	return append(color.Palette{color.Transparent}, palette.Plan9[:255]...)
+}
+
+// paletted quantizes img with dithering, half transparent pixels become transparent,
+// if the palette has a transparent color.
+func paletted(img image.Image, p color.Palette) *image.Paletted {
+	bounds := img.Bounds()
+	result := image.NewPaletted(bounds, p)
+
+	draw.FloydSteinberg.Draw(result, bounds, img, bounds.Min)
+
+	transparent := -1
+	for i, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			transparent = i
+			break
+		}
+	}
+
+	if transparent < 0 {
+		return result
+	}
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a < 0x8000 {
+				result.SetColorIndex(x, y, uint8(transparent))
+			}
+		}
+	}
+
+	return result
+}
+
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+
+	return false
+}
@@ -3,13 +3,21 @@ package imgproc
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"github.com/3d0c/imagio/config"
 	. "github.com/3d0c/imagio/query"
 	. "github.com/3d0c/imagio/utils"
 	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"reflect"
 	"testing"
 	"time"
@@ -44,6 +52,9 @@ func serveJpeg() {
 
 func init() {
 	go serveJpeg()
+
+	// test server is on localhost, which is denied by default
+	config.Get().Sources.Http.Deny = []string{}
 }
 
 type expected struct {
@@ -89,10 +100,10 @@ func TestProc(t *testing.T) {
 	}
 
 	for option, want := range cases {
-		b := Do(option)
-
-		if b == nil {
-			t.Errorf("Expected data, result is nil\n")
+		b, err := Do(context.Background(), option)
+		if err != nil {
+			t.Errorf("Expected data, got error: %v\n", err)
+			continue
 		}
 
 		cfg, imgType, err := image.DecodeConfig(bytes.NewReader(b))
@@ -111,3 +122,332 @@ func TestProc(t *testing.T) {
 		}
 	}
 }
+
+func TestMeta(t *testing.T) {
+	// the root is a part of configuration, it isn't shown in the link
+	cfg := config.Get()
+	cfg.Sources.Http.Root = test_server + "/"
+	defer func() { cfg.Sources.Http.Root = "" }()
+
+	o := &Options{
+		Format:  "json",
+		Base:    Construct(new(Source), "http://"+file_name).(*Source),
+		Scale:   Construct(new(Scale), "100x").(*Scale),
+		CropRoi: Construct(new(Roi), "center,500,500").(*Roi),
+	}
+
+	b, err := Do(context.Background(), o)
+	if err != nil {
+		t.Fatalf("Expected data, got error: %v\n", err)
+	}
+
+	result := &Meta{}
+	if err := json.Unmarshal(b, result); err != nil {
+		t.Fatalf("Unable to unmarshal %s. %v\n", b, err)
+	}
+
+	if result.Source.Link != "http://"+file_name || result.Source.Width != 1024 || result.Source.Height != 768 || result.Source.Mime != "image/jpeg" || result.Source.Alpha {
+		t.Errorf("Unexpected source description %v\n", result.Source)
+	}
+
+	if !reflect.DeepEqual(result.Crop, &Rect{262, 134, 500, 500}) {
+		t.Errorf("Expected crop is %v, got %v\n", &Rect{262, 134, 500, 500}, result.Crop)
+	}
+
+	if !reflect.DeepEqual(result.Result, &PixelDim{100, 100}) {
+		t.Errorf("Expected result size is %v, got %v\n", &PixelDim{100, 100}, result.Result)
+	}
+}
+
+func TestBlendRoi(t *testing.T) {
+	config.Get().Sources.File.Root = "/tmp"
+
+	fg := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	draw.Draw(fg, fg.Bounds(), image.NewUniform(color.NRGBA{255, 0, 0, 255}), image.ZP, draw.Src)
+
+	f, err := os.Create("/tmp/imagio-fg.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	png.Encode(f, fg)
+	f.Close()
+
+	// the corner is related to the 100x75 result, not to the 1024x768 source
+	o, err := Parse("/?source=http://" + test_server + "/" + file_name + "&scale=100x&format=png&blend_with=file://imagio-fg.png&blend_roi=se,10,10")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := Do(context.Background(), o)
+	if err != nil {
+		t.Fatalf("Unable to blend. %v\n", err)
+	}
+
+	result, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("Unable to decode result. %v\n", err)
+	}
+
+	red := color.NRGBA{255, 0, 0, 255}
+
+	if got := color.NRGBAModel.Convert(result.At(95, 70)).(color.NRGBA); !near(got, red) {
+		t.Errorf("Expected foreground at the bottom right corner, got %v\n", got)
+	}
+
+	if got := color.NRGBAModel.Convert(result.At(5, 5)).(color.NRGBA); near(got, red) {
+		t.Errorf("Expected no foreground at the top left corner, got %v\n", got)
+	}
+}
+
+func TestAlpha(t *testing.T) {
+	config.Get().Sources.File.Root = "/tmp"
+
+	// left half is transparent, right half is opaque red
+	img := image.NewNRGBA(image.Rect(0, 0, 100, 100))
+	for x := 50; x < 100; x++ {
+		for y := 0; y < 100; y++ {
+			img.Set(x, y, color.NRGBA{255, 0, 0, 255})
+		}
+	}
+
+	f, err := os.Create("/tmp/imagio-alpha.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	png.Encode(f, img)
+	f.Close()
+
+	cases := map[string][2]color.NRGBA{
+		"/?source=file://imagio-alpha.png&scale=50x&format=png":                    {{0, 0, 0, 0}, {255, 0, 0, 255}},
+		"/?source=file://imagio-alpha.png&scale=50x&format=jpeg&background=00ff00": {{0, 255, 0, 255}, {255, 0, 0, 255}},
+	}
+
+	for query, want := range cases {
+		o, err := Parse(query)
+		if err != nil {
+			t.Fatalf("Unable to parse %v. %v\n", query, err)
+		}
+
+		b, err := Do(context.Background(), o)
+		if err != nil {
+			t.Fatalf("Unable to process %v. %v\n", query, err)
+		}
+
+		result, _, err := image.Decode(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Unable to decode result of %v. %v\n", query, err)
+		}
+
+		for i, p := range []image.Point{{5, 25}, {45, 25}} {
+			got := color.NRGBAModel.Convert(result.At(p.X, p.Y)).(color.NRGBA)
+
+			if !near(got, want[i]) {
+				t.Errorf("Expected %v at %v of %v, got %v\n", want[i], p, query, got)
+			}
+		}
+	}
+}
+
+// near allows small deviations of jpeg.
+func near(a, b color.NRGBA) bool {
+	// as ints, uint8 difference wraps around
+	d := func(x, y uint8) bool { return int(x)-int(y) < 16 && int(y)-int(x) < 16 }
+
+	return d(a.R, b.R) && d(a.G, b.G) && d(a.B, b.B) && d(a.A, b.A)
+}
+
+func TestGif(t *testing.T) {
+	config.Get().Sources.File.Root = "/tmp"
+
+	// two frames, the second one is smaller than the canvas
+	p := color.Palette{color.Transparent, color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 0, 255, 255}}
+	first := image.NewPaletted(image.Rect(0, 0, 100, 100), p)
+	second := image.NewPaletted(image.Rect(50, 50, 100, 100), p)
+
+	for i := range first.Pix {
+		first.Pix[i] = 1
+	}
+
+	for i := range second.Pix {
+		second.Pix[i] = 2
+	}
+
+	f, err := os.Create("/tmp/imagio-anim.gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gif.EncodeAll(f, &gif.GIF{Image: []*image.Paletted{first, second}, Delay: []int{10, 20}, LoopCount: 3})
+	f.Close()
+
+	if f, err = os.Create("/tmp/imagio-still.gif"); err != nil {
+		t.Fatal(err)
+	}
+
+	gif.EncodeAll(f, &gif.GIF{Image: []*image.Paletted{first}, Delay: []int{10}})
+	f.Close()
+
+	cases := map[string]int{
+		"/?source=file://imagio-anim.gif&scale=50x&format=gif":                  2,
+		"/?source=file://imagio-anim.gif&scale=50x&format=gif&first_frame=true": 1,
+		"/?source=file://imagio-anim.gif&scale=50x&format=auto":                 2,
+		"/?source=file://imagio-still.gif&scale=50x&format=gif":                 1,
+	}
+
+	for query, frames := range cases {
+		o, err := Parse(query)
+		if err != nil {
+			t.Fatalf("Unable to parse %v. %v\n", query, err)
+		}
+
+		b, err := Do(context.Background(), o)
+		if err != nil {
+			t.Fatalf("Unable to process %v. %v\n", query, err)
+		}
+
+		result, err := gif.DecodeAll(bytes.NewReader(b))
+		if err != nil {
+			t.Fatalf("Unable to decode result of %v. %v\n", query, err)
+		}
+
+		if len(result.Image) != frames || result.Config.Width != 50 || result.Config.Height != 50 {
+			t.Errorf("Expected %d frames of 50x50 for %v, got %d of %dx%d\n", frames, query, len(result.Image), result.Config.Width, result.Config.Height)
+		}
+
+		if frames == 2 && (result.Delay[1] != 20 || result.LoopCount != 3) {
+			t.Errorf("Expected delay 20 and loop count 3, got %v, %v\n", result.Delay, result.LoopCount)
+		}
+
+		// the second frame is composed over the first one
+		if frames == 2 {
+			r, _, _, _ := result.Image[1].At(5, 5).RGBA()
+			_, _, b, _ := result.Image[1].At(45, 45).RGBA()
+
+			if r>>8 < 200 || b>>8 < 200 {
+				t.Errorf("Expected red and blue pixels in the second frame, got %v, %v\n", result.Image[1].At(5, 5), result.Image[1].At(45, 45))
+			}
+		}
+	}
+
+	o, err := Parse("/?source=file://imagio-anim.gif&scale=50x&format=png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := Do(context.Background(), o)
+	if err != nil {
+		t.Fatalf("Unable to process gif to png. %v\n", err)
+	}
+
+	if img, err := png.Decode(bytes.NewReader(b)); err != nil || img.Bounds().Dx() != 50 {
+		t.Errorf("Expected png of 50px width, got %v\n", err)
+	}
+}
+
+func TestGifPalettes(t *testing.T) {
+	config.Get().Sources.File.Root = "/tmp"
+
+	// the second frame covers a quarter of the canvas and has its own palette without red
+	red, green := color.NRGBA{255, 0, 0, 255}, color.NRGBA{0, 255, 0, 255}
+	first := image.NewPaletted(image.Rect(0, 0, 20, 20), color.Palette{red, color.NRGBA{0, 0, 255, 255}})
+	second := image.NewPaletted(image.Rect(0, 0, 10, 10), color.Palette{green, color.Black})
+
+	// the first palette becomes the global one by default, the second case has local palettes only
+	cases := map[string]image.Config{
+		"imagio-global.gif": {},
+		"imagio-local.gif":  {Width: 20, Height: 20},
+	}
+
+	for name, cfg := range cases {
+		f, err := os.Create("/tmp/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gif.EncodeAll(f, &gif.GIF{Image: []*image.Paletted{first, second}, Delay: []int{10, 10}, Config: cfg})
+		f.Close()
+
+		o, err := Parse("/?source=file://" + name + "&scale=20x&format=gif")
+		if err != nil {
+			t.Fatalf("Unable to parse %v. %v\n", name, err)
+		}
+
+		b, err := Do(context.Background(), o)
+		if err != nil {
+			t.Fatalf("Unable to process %v. %v\n", name, err)
+		}
+
+		result, err := gif.DecodeAll(bytes.NewReader(b))
+		if err != nil || len(result.Image) != 2 {
+			t.Fatalf("Expected 2 frames of %v, got %v\n", name, err)
+		}
+
+		// pixels of the first frame keep their color in the second one
+		for p, want := range map[image.Point]color.NRGBA{{3, 3}: green, {16, 16}: red} {
+			if got := color.NRGBAModel.Convert(result.Image[1].At(p.X, p.Y)).(color.NRGBA); !near(got, want) {
+				t.Errorf("Expected %v at %v of the second frame of %v, got %v\n", want, p, name, got)
+			}
+		}
+	}
+}
+
+func TestGifFrames(t *testing.T) {
+	cfg := config.Get()
+	cfg.Sources.File.Root = "/tmp"
+
+	defer func(max int64) { cfg.Limits.MaxPixels = max }(cfg.Limits.MaxPixels)
+
+	anim := &gif.GIF{}
+	for i := 0; i < 1000; i++ {
+		anim.Image = append(anim.Image, image.NewPaletted(image.Rect(0, 0, 100, 100), color.Palette{color.Black, color.White}))
+		anim.Delay = append(anim.Delay, 1)
+	}
+
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, anim)
+
+	if n, err := countFrames(buf.Bytes()); err != nil || n != 1000 {
+		t.Errorf("Expected 1000 frames, got %v, %v\n", n, err)
+	}
+
+	if _, err := countFrames(buf.Bytes()[:10]); err == nil {
+		t.Errorf("Expected error for truncated gif\n")
+	}
+
+	if err := ioutil.WriteFile("/tmp/imagio-frames.gif", buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// every frame is within the limit, all of them are not
+	cfg.Limits.MaxPixels = 1000000
+
+	o, err := Parse("/?source=file://imagio-frames.gif&scale=50x&format=gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Do(context.Background(), o); StatusOf(err) != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %v, got %v\n", http.StatusRequestEntityTooLarge, err)
+	}
+}
+
+func TestPoolCancel(t *testing.T) {
+	p := &pool{slots: make(chan struct{}, 1), queue: 1, timeout: time.Minute}
+
+	if err := p.acquire(context.Background()); err != nil {
+		t.Fatalf("Expected a free worker, got %v\n", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	start := time.Now()
+
+	if err := p.acquire(ctx); StatusOf(err) != http.StatusServiceUnavailable || time.Since(start) > time.Second {
+		t.Errorf("Expected cancelled wait with status %v, got %v after %v\n", http.StatusServiceUnavailable, err, time.Since(start))
+	}
+
+	p.release()
+}
@@ -0,0 +1,57 @@
+package imgproc
+
+import (
+	"encoding/json"
+	. "github.com/3d0c/imagio/query"
+)
+
+// Meta describes the source image and the result, which would be produced
+// for the same options. It's a response for `format=json` requests.
+type Meta struct {
+	Source struct {
+		Link   string `json:"link"`
+		Type   string `json:"type"`
+		Mime   string `json:"mime"`
+		Width  int    `json:"width"`
+		Height int    `json:"height"`
+		Bytes  int    `json:"bytes"`
+		Alpha  bool   `json:"alpha"`
+
+		// EXIF orientation, width and height are given for the oriented image
+		Orientation int `json:"orientation"`
+	} `json:"source"`
+
+	Crop   *Rect     `json:"crop"`
+	Result *PixelDim `json:"result"`
+}
+
+func meta(o *Options) ([]byte, error) {
+	this := &Meta{}
+
+	this.Source.Link = o.Base.Key()
+	this.Source.Type = o.Base.Type()
+	this.Source.Mime = o.Base.Mime()
+	this.Source.Width = o.Base.Size().Width
+	this.Source.Height = o.Base.Size().Height
+	this.Source.Bytes = len(o.Base.Blob())
+	this.Source.Alpha = o.Base.HasAlpha()
+	this.Source.Orientation = o.Base.Orientation()
+
+	zoom, roi, err := o.Geometry()
+	if err != nil {
+		return nil, err
+	}
+
+	this.Crop = roi
+	this.Result = zoom
+
+	if zoom == nil {
+		this.Result = &PixelDim{roi.Width, roi.Height}
+	}
+
+	if canvas := o.Canvas(zoom); canvas != nil {
+		this.Result = &PixelDim{canvas.Width, canvas.Height}
+	}
+
+	return json.Marshal(this)
+}
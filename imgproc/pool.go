@@ -0,0 +1,82 @@
+package imgproc
+
+import (
+	"context"
+	"github.com/3d0c/imagio/config"
+	"github.com/3d0c/imagio/stat"
+	. "github.com/3d0c/imagio/utils"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// pool limits count of concurrent transformations. Requests, which can't get a worker,
+// wait in a bounded queue not longer than the queue timeout or until the request is cancelled,
+// the rest are rejected with 503.
+type pool struct {
+	slots   chan struct{}
+	queue   int64
+	timeout time.Duration
+}
+
+var workers *pool
+var workersOnce sync.Once
+
+func getPool() *pool {
+	workersOnce.Do(func() {
+		workers = &pool{
+			slots:   make(chan struct{}, config.Get().WorkersSize()),
+			queue:   int64(config.Get().QueueSize()),
+			timeout: config.Get().QueueTimeout(),
+		}
+
+		atomic.StoreInt64(&stat.Workers.Size, int64(cap(workers.slots)))
+		atomic.StoreInt64(&stat.Workers.Queue, workers.queue)
+	})
+
+	return workers
+}
+
+func (this *pool) acquire(ctx context.Context) error {
+	select {
+	case this.slots <- struct{}{}:
+		atomic.AddInt64(&stat.Workers.Busy, 1)
+		return nil
+
+	default:
+	}
+
+	if atomic.AddInt64(&stat.Workers.Waiting, 1) > this.queue {
+		atomic.AddInt64(&stat.Workers.Waiting, -1)
+		atomic.AddInt64(&stat.Workers.Rejected, 1)
+
+		return &Error{Status: http.StatusServiceUnavailable, Message: "Server is busy, queue is full.", RetryAfter: time.Second}
+	}
+
+	defer atomic.AddInt64(&stat.Workers.Waiting, -1)
+
+	timer := time.NewTimer(this.timeout)
+	defer timer.Stop()
+
+	select {
+	case this.slots <- struct{}{}:
+		atomic.AddInt64(&stat.Workers.Busy, 1)
+		return nil
+
+	case <-timer.C:
+		atomic.AddInt64(&stat.Workers.TimedOut, 1)
+
+		return &Error{Status: http.StatusServiceUnavailable, Message: "Server is busy, timeout waiting for a worker.", RetryAfter: this.timeout}
+
+	case <-ctx.Done():
+		atomic.AddInt64(&stat.Workers.Cancelled, 1)
+
+		return &Error{Status: http.StatusServiceUnavailable, Message: "Request is cancelled waiting for a worker.", RetryAfter: time.Second}
+	}
+}
+
+func (this *pool) release() {
+	atomic.AddInt64(&stat.Workers.Busy, -1)
+	<-this.slots
+}
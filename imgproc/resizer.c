@@ -1,6 +1,225 @@
 #include "cv_handler.h"
 
-Blob *resizer(Blob *in, PixelDim *zoom, int quality, int method, const char *format, CvRect *roi) {
+// Interpolation mixes colors of transparent pixels into visible ones, so 4-channel images
+// are resized with premultiplied alpha.
+static void premultiply(IplImage *img) {
+	int x, y, c;
+
+	for(y = 0; y < img->height; y++) {
+		unsigned char *px = (unsigned char *)img->imageData + y * img->widthStep;
+
+		for(x = 0; x < img->width; x++, px += 4) {
+			for(c = 0; c < 3; c++) {
+				px[c] = (px[c] * px[3] + 127) / 255;
+			}
+		}
+	}
+}
+
+static void unpremultiply(IplImage *img) {
+	int x, y, c;
+
+	for(y = 0; y < img->height; y++) {
+		unsigned char *px = (unsigned char *)img->imageData + y * img->widthStep;
+
+		for(x = 0; x < img->width; x++, px += 4) {
+			if(px[3] == 0 || px[3] == 255) {
+				continue;
+			}
+
+			for(c = 0; c < 3; c++) {
+				int v = (px[c] * 255 + px[3] / 2) / px[3];
+				px[c] = (v > 255) ? 255 : v;
+			}
+		}
+	}
+}
+
+// Returns a 3-channel copy of 4-channel img, composed over bg color.
+static IplImage *flatten(IplImage *img, CvScalar *bg) {
+	int x, y, c;
+	IplImage *out = cvCreateImage(cvGetSize(img), IPL_DEPTH_8U, 3);
+
+	if(!out) {
+		return NULL;
+	}
+
+	for(y = 0; y < img->height; y++) {
+		unsigned char *src = (unsigned char *)img->imageData + y * img->widthStep;
+		unsigned char *dst = (unsigned char *)out->imageData + y * out->widthStep;
+
+		for(x = 0; x < img->width; x++, src += 4, dst += 3) {
+			for(c = 0; c < 3; c++) {
+				dst[c] = (src[c] * src[3] + (int)bg->val[c] * (255 - src[3]) + 127) / 255;
+			}
+		}
+	}
+
+	return out;
+}
+
+// OpenCV 3.1+ applies EXIF orientation of color images on decoding. Orientation is applied by orient()
+// for every version, so it's ignored by the decoder, otherwise images would be turned twice.
+#if CV_MAJOR_VERSION > 3 || (CV_MAJOR_VERSION == 3 && CV_MINOR_VERSION >= 1)
+#define DECODE_COLOR (CV_LOAD_IMAGE_COLOR | CV_LOAD_IMAGE_IGNORE_ORIENTATION)
+#else
+#define DECODE_COLOR CV_LOAD_IMAGE_COLOR
+#endif
+
+// Decodes with alpha channel if it's requested and the image has 8-bit one, otherwise as 3-channel color.
+// Unchanged images are never oriented by the decoder.
+static IplImage *decode(CvMat *buf, int alpha) {
+	IplImage *img;
+
+	if(!alpha) {
+		return cvDecodeImage(buf, DECODE_COLOR);
+	}
+
+	if((img = cvDecodeImage(buf, CV_LOAD_IMAGE_UNCHANGED)) && img->nChannels == 4 && img->depth == IPL_DEPTH_8U) {
+		return img;
+	}
+
+	if(img) {
+		cvReleaseImage(&img);
+	}
+
+	return cvDecodeImage(buf, DECODE_COLOR);
+}
+
+// Applies EXIF orientation, returns a new image or img itself for the default orientation.
+static IplImage *orient(IplImage *img, int orientation) {
+	IplImage *out;
+
+	if(orientation < 2 || orientation > 8) {
+		return img;
+	}
+
+	if(orientation <= 4) {
+		// 2 mirrored horizontally, 3 rotated 180, 4 mirrored vertically
+		int modes[] = {1, -1, 0};
+
+		if((out = cvCreateImage(cvGetSize(img), img->depth, img->nChannels))) {
+			cvFlip(img, out, modes[orientation - 2]);
+		}
+
+		return out;
+	}
+
+	if(!(out = cvCreateImage(cvSize(img->height, img->width), img->depth, img->nChannels))) {
+		return NULL;
+	}
+
+	cvTranspose(img, out);
+
+	// 5 is transposed, 6 rotated 90 CW, 7 transversed, 8 rotated 90 CCW
+	switch(orientation) {
+	case 6:
+		cvFlip(out, NULL, 1);
+		break;
+
+	case 7:
+		cvFlip(out, NULL, -1);
+		break;
+
+	case 8:
+		cvFlip(out, NULL, 0);
+		break;
+	}
+
+	return out;
+}
+
+// Rotates img clockwise, the result fits the whole rotated image, corners are filled with fill color.
+static IplImage *rotate(IplImage *img, double angle, CvScalar fill) {
+	// right angles are exact
+	if(angle == 90) {
+		return orient(img, 6);
+	}
+
+	if(angle == 180) {
+		return orient(img, 3);
+	}
+
+	if(angle == 270) {
+		return orient(img, 8);
+	}
+
+	double rad = angle * CV_PI / 180.;
+	int width = (int)(fabs(img->width * cos(rad)) + fabs(img->height * sin(rad)) + 0.5);
+	int height = (int)(fabs(img->width * sin(rad)) + fabs(img->height * cos(rad)) + 0.5);
+
+	IplImage *out = cvCreateImage(cvSize(width, height), img->depth, img->nChannels);
+	CvMat *m = cvCreateMat(2, 3, CV_32FC1);
+
+	if(!out || !m) {
+		cvReleaseImage(&out);
+		cvReleaseMat(&m);
+		return NULL;
+	}
+
+	// OpenCV rotates counter-clockwise around the center, then the center is moved to the center of result
+	cv2DRotationMatrix(cvPoint2D32f(img->width / 2., img->height / 2.), -angle, 1., m);
+	cvmSet(m, 0, 2, cvmGet(m, 0, 2) + (width - img->width) / 2.);
+	cvmSet(m, 1, 2, cvmGet(m, 1, 2) + (height - img->height) / 2.);
+
+	cvWarpAffine(img, out, m, CV_INTER_LINEAR + CV_WARP_FILL_OUTLIERS, fill);
+	cvReleaseMat(&m);
+
+	return out;
+}
+
+// Applies orientation, rotation and flip, each step replaces img.
+static IplImage *transform(IplImage *img, Transform *t) {
+	// flips are orientations too: 2 is horizontal, 4 is vertical, 3 is both
+	int flips[] = {1, 2, 4, 3};
+	int step;
+
+	for(step = 0; t && step < 3 && img; step++) {
+		IplImage *out = img;
+
+		switch(step) {
+		case 0:
+			out = orient(img, t->orientation);
+			break;
+
+		case 1:
+			if(t->angle != 0) {
+				out = rotate(img, t->angle, t->fill);
+			}
+			break;
+
+		case 2:
+			out = orient(img, flips[t->flip & 3]);
+			break;
+		}
+
+		if(out != img) {
+			cvReleaseImage(&img);
+			img = out;
+		}
+	}
+
+	return img;
+}
+
+// Places img on pad->width x pad->height canvas at pad->x, pad->y, the rest is filled with fill color.
+static IplImage *padding(IplImage *img, CvRect *pad, CvScalar fill) {
+	IplImage *out = cvCreateImage(cvSize(pad->width, pad->height), img->depth, img->nChannels);
+
+	if(!out) {
+		return NULL;
+	}
+
+	cvSet(out, fill, NULL);
+	cvSetImageROI(out, cvRect(pad->x, pad->y, img->width, img->height));
+	cvCopy(img, out, NULL);
+	cvResetImageROI(out);
+
+	return out;
+}
+
+// If alpha is set, transparency is kept. If bg is set too, the image is flattened onto it.
+Blob *resizer(Blob *in, PixelDim *zoom, int quality, int method, const char *format, CvRect *roi, int alpha, CvScalar *bg, Transform *t, CvRect *pad) {
 	if (!in) {
 		fprintf(stderr, "resizer.c: Wrong call. 'in' is NULL\n");
 		return NULL;
@@ -12,14 +231,13 @@ Blob *resizer(Blob *in, PixelDim *zoom, int quality, int method, const char *for
 	}
 
 	IplImage *srcImg, *resultImg;
-	int p[3] = {CV_IMWRITE_JPEG_QUALITY, quality, 0};
 
 	cvUseOptimized(1);
 	
 	CvMat *buf = cvCreateMat(1, in->length, CV_8UC1);
 	buf->data.ptr = in->data;
 
-	srcImg = cvDecodeImage(buf, CV_LOAD_IMAGE_COLOR);
+	srcImg = decode(buf, alpha);
 	cvReleaseMat(&buf);
 
 	if(!srcImg) {
@@ -27,6 +245,28 @@ Blob *resizer(Blob *in, PixelDim *zoom, int quality, int method, const char *for
 		return NULL;
 	}
 
+	if(!(srcImg = transform(srcImg, t))) {
+		fprintf(stderr, "resizer.c: transform() error.\n");
+		return NULL;
+	}
+
+	if(srcImg->nChannels == 4 && bg) {
+		IplImage *flat = flatten(srcImg, bg);
+
+		cvReleaseImage(&srcImg);
+
+		if(!(srcImg = flat)) {
+			fprintf(stderr, "resizer.c: flatten() error.\n");
+			return NULL;
+		}
+	}
+
+	int premultiplied = (srcImg->nChannels == 4 && zoom);
+
+	if(premultiplied) {
+		premultiply(srcImg);
+	}
+
 	if(roi) {
 		cvSetImageROI(srcImg, *roi);
 	}
@@ -46,7 +286,31 @@ Blob *resizer(Blob *in, PixelDim *zoom, int quality, int method, const char *for
 		cvResize(srcImg, resultImg, method);
 	}
 
-	CvMat *result = cvEncodeImage(format, resultImg, p);
+	if(premultiplied) {
+		unpremultiply(resultImg);
+	}
+
+	if(pad) {
+		IplImage *padded = padding(resultImg, pad, t->fill);
+
+		cvReleaseImage(&resultImg);
+
+		if(!(resultImg = padded)) {
+			fprintf(stderr, "resizer.c: padding() error.\n");
+			cvReleaseImage(&srcImg);
+			return NULL;
+		}
+	}
+
+	CvMat *result = encodeImage(format, resultImg, quality);
+
+	cvReleaseImage(&srcImg);
+	cvReleaseImage(&resultImg);
+
+	if(!result) {
+		fprintf(stderr, "resizer.c: cvEncodeImage() error.\n");
+		return NULL;
+	}
 
 	Blob *out = malloc(sizeof(Blob));
 	out->data = malloc(result->step);
@@ -55,8 +319,6 @@ Blob *resizer(Blob *in, PixelDim *zoom, int quality, int method, const char *for
 	memcpy(out->data, result->data.ptr, result->step);
 	
 	cvReleaseMat(&result);
-	cvReleaseImage(&srcImg);
-	cvReleaseImage(&resultImg);
-	
+
 	return out;
 }
@@ -2,22 +2,61 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"github.com/3d0c/imagio/cache"
 	"github.com/3d0c/imagio/config"
 	"github.com/3d0c/imagio/imgproc"
 	"github.com/3d0c/imagio/query"
+	"github.com/3d0c/imagio/sign"
+	"github.com/3d0c/imagio/stat"
 	. "github.com/3d0c/imagio/utils"
 	"github.com/golang/groupcache"
+	"github.com/golang/groupcache/singleflight"
 	"log"
 	"net/http"
 	"os"
 	"runtime"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var cacheGroup *groupcache.Group
+var sourceGroup *groupcache.Group
+var negativeCache *cache.Negative
+var diskCache *cache.Disk
+var nocache singleflight.Group
+
+// await waits for a load, which is shared by concurrent requests of the same key, so it isn't
+// cancelled by any of them. A client, which disconnects, only stops waiting, the load goes on for the others.
+func await(ctx context.Context, load func() ([]byte, error)) ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
+	}
+
+	done := make(chan result, 1)
+
+	go func() {
+		data, err := load()
+		done <- result{data, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.data, r.err
+
+	case <-ctx.Done():
+		atomic.AddInt64(&stat.Workers.Cancelled, 1)
+
+		return nil, &Error{Status: http.StatusServiceUnavailable, Message: "Request is cancelled waiting for the result.", RetryAfter: time.Second}
+	}
+}
 
 func initCacheGroup() {
 	self := config.Get().CacheSelf()
@@ -30,12 +69,45 @@ func initCacheGroup() {
 		go http.ListenAndServe(strings.TrimLeft(self, "http://"), http.HandlerFunc(pool.ServeHTTP))
 	}
 
+	negativeCache = cache.NewNegative(config.Get().NegativeSize(), config.Get().NegativeTtl())
+
+	if dir := config.Get().DiskCacheDir(); dir != "" {
+		var err error
+
+		if diskCache, err = cache.NewDisk(dir, config.Get().DiskCacheSize()); err != nil {
+			log.Fatalf("Unable to initialize disk cache in %v. %v\n", dir, err)
+		}
+
+		log.Printf("Disk cache in %v, %d files.\n", dir, diskCache.Len())
+	}
+
+	sourceGroup = query.InitSourceGroup(config.Get().SourceCacheSize())
+
 	cacheGroup = groupcache.NewGroup("imagio-storage", config.Get().CacheSize(), groupcache.GetterFunc(
 		func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
-			dest.SetBytes(imgproc.Do(
-				Construct(new(query.Options), key).(*query.Options),
-			))
-			return nil
+			if diskCache != nil {
+				if data, found := diskCache.Get(key); found {
+					return dest.SetBytes(data)
+				}
+			}
+
+			o, err := query.ParseKey(key)
+			if err != nil {
+				return err
+			}
+
+			data, err := imgproc.Do(context.Background(), o)
+			if err != nil {
+				return err
+			}
+
+			if diskCache != nil {
+				if err := diskCache.Add(key, data); err != nil {
+					log.Println("Unable to write disk cache.", err)
+				}
+			}
+
+			return dest.SetBytes(data)
 		}),
 	)
 }
@@ -47,6 +119,8 @@ func init() {
 
 func main() {
 	dumpcfg := flag.Bool("dumpcfg", false, "Dump config.")
+	signurl := flag.String("sign", "", "Sign URL with the first of configured signature keys, e.g. '/?source=1.jpg&scale=800x'.")
+	expires := flag.Duration("expires", 0, "Expiration period for signed URL, e.g. '24h'. Never expires by default.")
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stdout, "Usage: %s [OPTIONS]\n", os.Args[0])
@@ -60,34 +134,174 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *signurl != "" {
+		os.Exit(signUrl(*signurl, *expires))
+	}
+
+	if err := query.CheckDefaults(); err != nil {
+		log.Fatalln("Invalid config.", err)
+	}
+
 	initCacheGroup()
 
 	log.Printf("Service listen on %v\n", config.Get().Listen())
 
-	http.HandleFunc("/",
+	http.HandleFunc("/", stat.Handler("/",
+		func(w http.ResponseWriter, r *http.Request) {
+			if err := sign.Verify(r.URL, config.Get().SignatureKeys()); err != nil {
+				WriteError(w, err)
+				return
+			}
+
+			o, err := query.Parse(r.URL)
+			if err != nil {
+				log.Println(err)
+				WriteError(w, err)
+				return
+			}
+
+			if o.Negotiate(r.Header.Get("Accept")) {
+				w.Header().Set("Vary", "Accept")
+			}
+
+			if err := negativeCache.Get(o.Key()); err != nil {
+				WriteError(w, err)
+				return
+			}
+
+			// failed transformations are not stored by groupcache, Getter returns an error
+			data, err := await(r.Context(), func() ([]byte, error) {
+				var data []byte
+				var ctx groupcache.Context
+
+				err := cacheGroup.Get(ctx, o.Key(), groupcache.AllocatingByteSliceSink(&data))
+
+				return data, err
+			})
+			if err != nil {
+				log.Println(err)
+
+				// overloaded server is not a reason to fail the same request later
+				if StatusOf(err) != http.StatusServiceUnavailable {
+					negativeCache.Add(o.Key(), err)
+				}
+
+				WriteError(w, err)
+				return
+			}
+
+			serve(w, r, o.Key(), o.Format, data)
+		},
+	))
+
+	http.HandleFunc("/nocache", stat.Handler("/nocache",
 		func(w http.ResponseWriter, r *http.Request) {
-			var data []byte
-			var ctx groupcache.Context
+			if err := sign.Verify(r.URL, config.Get().SignatureKeys()); err != nil {
+				WriteError(w, err)
+				return
+			}
+
+			o, err := query.Parse(r.URL)
+			if err != nil {
+				log.Println(err)
+				WriteError(w, err)
+				return
+			}
+
+			if o.Negotiate(r.Header.Get("Accept")) {
+				w.Header().Set("Vary", "Accept")
+			}
+
+			// identical concurrent requests share one transformation
+			data, err := await(r.Context(), func() ([]byte, error) {
+				v, err := nocache.Do(o.Key(), func() (interface{}, error) {
+					return imgproc.Do(context.Background(), o)
+				})
+				if err != nil {
+					return nil, err
+				}
 
-			cacheGroup.Get(ctx, r.URL.String(), groupcache.AllocatingByteSliceSink(&data))
+				return v.([]byte), nil
+			})
+			if err != nil {
+				log.Println(err)
+				WriteError(w, err)
+				return
+			}
 
-			http.ServeContent(w, r, r.URL.String(), time.Now(), bytes.NewReader(data))
+			serve(w, r, o.Key(), o.Format, data)
 		},
-	)
+	))
 
-	http.HandleFunc("/nocache",
+	http.HandleFunc("/stat",
 		func(w http.ResponseWriter, r *http.Request) {
-			var result []byte
-			result = imgproc.Do(Construct(new(query.Options), r.URL).(*query.Options))
-			w.Write(result)
+			b, err := json.MarshalIndent(stat.Collect(cacheGroup, sourceGroup), "", " ")
+			if err != nil {
+				WriteError(w, err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(b)
 		},
 	)
 
-	http.HandleFunc("/stat",
+	http.HandleFunc("/metrics",
 		func(w http.ResponseWriter, r *http.Request) {
-			// awesome stat. not implemented yet.
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+			stat.WriteMetrics(w, cacheGroup, sourceGroup)
 		},
 	)
 
 	log.Fatal(http.ListenAndServe(config.Get().Listen(), nil))
 }
+
+// serve responds with the result of transformation, identified by key.
+// Conditional requests with If-None-Match are handled by http.ServeContent.
+func serve(w http.ResponseWriter, r *http.Request, key string, format string, data []byte) {
+	hash := sha1.New()
+	hash.Write([]byte(key))
+	hash.Write([]byte{0})
+	hash.Write(data)
+
+	// png or jpeg is chosen for `auto` format by the source
+	if format == query.AUTO {
+		format = query.FormatOf(data)
+	}
+
+	w.Header().Set("Content-Type", query.MimeType(format))
+	w.Header().Set("ETag", `"`+hex.EncodeToString(hash.Sum(nil))+`"`)
+
+	if maxAge := config.Get().MaxAge(); maxAge > 0 {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+
+	stat.OutputBytes.Add(float64(len(data)), format)
+
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+}
+
+func signUrl(rawurl string, expires time.Duration) int {
+	keys := config.Get().SignatureKeys()
+	if len(keys) == 0 {
+		fmt.Fprintln(os.Stderr, "There are no signature keys in config.")
+		return 1
+	}
+
+	var deadline time.Time
+	if expires > 0 {
+		deadline = time.Now().Add(expires)
+	}
+
+	signed, err := sign.Sign(rawurl, keys[0], deadline)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to sign URL.", err)
+		return 1
+	}
+
+	fmt.Println(signed)
+
+	return 0
+}
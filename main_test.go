@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/3d0c/imagio/config"
+	. "github.com/3d0c/imagio/utils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestServe(t *testing.T) {
+	cfg := config.Get()
+	defer func(maxAge int) { cfg.CacheMaxAge = maxAge }(cfg.CacheMaxAge)
+
+	get := func(key string, data []byte, etag string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/?source=1.jpg", nil)
+
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+
+		serve(w, r, key, "png", data)
+
+		return w
+	}
+
+	cfg.CacheMaxAge = 0
+
+	w := get("key", []byte("data"), "")
+	etag := w.Header().Get("ETag")
+
+	if w.Code != http.StatusOK || w.Body.String() != "data" || w.Header().Get("Content-Type") != "image/png" {
+		t.Errorf("Unexpected response %v, %q, %v\n", w.Code, w.Body.String(), w.Header())
+	}
+
+	if cc := w.Header().Get("Cache-Control"); cc != fmt.Sprintf("public, max-age=%d", config.MAX_AGE) {
+		t.Errorf("Expected default max-age, got %q\n", cc)
+	}
+
+	// the same result has the same tag, another key or data changes it
+	if tag := get("key", []byte("data"), "").Header().Get("ETag"); etag == "" || tag != etag {
+		t.Errorf("Expected stable ETag %v, got %v\n", etag, tag)
+	}
+
+	for _, tag := range []string{get("key2", []byte("data"), "").Header().Get("ETag"), get("key", []byte("data2"), "").Header().Get("ETag")} {
+		if tag == etag {
+			t.Errorf("Expected ETag differs from %v\n", etag)
+		}
+	}
+
+	if w := get("key", []byte("data"), etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected %v for matching If-None-Match, got %v, %q\n", http.StatusNotModified, w.Code, w.Body.String())
+	}
+
+	if w := get("key", []byte("data2"), etag); w.Code != http.StatusOK {
+		t.Errorf("Expected %v for stale If-None-Match, got %v\n", http.StatusOK, w.Code)
+	}
+
+	cfg.CacheMaxAge = -1
+
+	if cc := get("key", []byte("data"), "").Header().Get("Cache-Control"); cc != "no-cache" {
+		t.Errorf("Expected no-cache for negative max_age, got %q\n", cc)
+	}
+}
+
+func TestAwait(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	release := make(chan struct{})
+	loaded := make(chan []byte, 1)
+
+	load := func() ([]byte, error) {
+		<-release
+		return []byte("data"), nil
+	}
+
+	cancel()
+
+	// the first client is gone, the shared load isn't cancelled
+	if _, err := await(ctx, func() ([]byte, error) {
+		data, err := load()
+		loaded <- data
+		return data, err
+	}); StatusOf(err) != http.StatusServiceUnavailable {
+		t.Errorf("Expected %v for cancelled request, got %v\n", http.StatusServiceUnavailable, err)
+	}
+
+	close(release)
+
+	select {
+	case data := <-loaded:
+		if string(data) != "data" {
+			t.Errorf("Expected data is loaded, got %q\n", data)
+		}
+
+	case <-time.After(time.Second):
+		t.Errorf("Expected load goes on after the client is gone\n")
+	}
+
+	if data, err := await(context.Background(), load); err != nil || string(data) != "data" {
+		t.Errorf("Expected data, got %q, %v\n", data, err)
+	}
+}
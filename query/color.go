@@ -0,0 +1,33 @@
+package query
+
+import (
+	"encoding/hex"
+	. "github.com/3d0c/imagio/utils"
+	"net/http"
+	"strings"
+)
+
+// Color is an RGB color, e.g. a background for images with alpha channel.
+type Color struct {
+	R, G, B uint8
+}
+
+// parseColor accepts hex colors with optional `#`, in short `fff` or full `ffffff` form.
+func parseColor(v string) (*Color, error) {
+	s := strings.TrimPrefix(v, "#")
+
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 3 {
+		return nil, NewError(http.StatusBadRequest, "Illegal color '%v', expected hex `rgb` or `rrggbb`.", v)
+	}
+
+	return &Color{b[0], b[1], b[2]}, nil
+}
+
+func (this *Color) String() string {
+	return hex.EncodeToString([]byte{this.R, this.G, this.B})
+}
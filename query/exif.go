@@ -0,0 +1,107 @@
+package query
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	ORIENTATION_TAG = 0x0112
+
+	// Orientations, which swap width and height.
+	TRANSPOSE  = 5
+	ROTATE_90  = 6
+	TRANSVERSE = 7
+	ROTATE_270 = 8
+)
+
+// jpegOrientation returns EXIF orientation from 1 to 8 of jpeg blob, 1 is the default one.
+// Only markers before the image data are scanned, the data itself isn't touched.
+func jpegOrientation(b []byte) int {
+	if len(b) < 4 || b[0] != 0xff || b[1] != 0xd8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(b); {
+		if b[i] != 0xff {
+			return 1
+		}
+
+		marker := b[i+1]
+
+		// padding
+		if marker == 0xff {
+			i++
+			continue
+		}
+
+		// start of scan or end of image, there is no exif before
+		if marker == 0xda || marker == 0xd9 {
+			return 1
+		}
+
+		length := int(binary.BigEndian.Uint16(b[i+2:]))
+		if length < 2 || i+2+length > len(b) {
+			return 1
+		}
+
+		segment := b[i+4 : i+2+length]
+
+		if marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+
+		i += 2 + length
+	}
+
+	return 1
+}
+
+// tiffOrientation reads Orientation tag of IFD0.
+func tiffOrientation(b []byte) int {
+	var order binary.ByteOrder
+
+	if len(b) < 8 {
+		return 1
+	}
+
+	switch string(b[:2]) {
+	case "II":
+		order = binary.LittleEndian
+
+	case "MM":
+		order = binary.BigEndian
+
+	default:
+		return 1
+	}
+
+	if order.Uint16(b[2:]) != 42 {
+		return 1
+	}
+
+	ifd := int(order.Uint32(b[4:]))
+	if ifd < 8 || ifd+2 > len(b) {
+		return 1
+	}
+
+	count := int(order.Uint16(b[ifd:]))
+
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(b) {
+			return 1
+		}
+
+		// SHORT value is in the first two bytes of the value field
+		if order.Uint16(b[entry:]) == ORIENTATION_TAG && order.Uint16(b[entry+2:]) == 3 {
+			if v := int(order.Uint16(b[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+
+			return 1
+		}
+	}
+
+	return 1
+}
@@ -0,0 +1,177 @@
+package query
+
+import (
+	. "github.com/3d0c/imagio/utils"
+	"math"
+	"net/http"
+)
+
+// Fit modes for scale with both dimensions, e.g. `scale=300x300`.
+const (
+	// the image is inside the box, it isn't enlarged
+	FIT_INSIDE = "inside"
+	// the image is inside the box, the box is padded with fill color
+	FIT_CONTAIN = "contain"
+	// the image covers the box, the rest is cropped by gravity
+	FIT_COVER = "cover"
+	// the image is stretched to the box
+	FIT_FILL = "fill"
+)
+
+var fits = map[string]bool{FIT_INSIDE: true, FIT_CONTAIN: true, FIT_COVER: true, FIT_FILL: true}
+
+func parseFit(v string) (string, error) {
+	if v == "" {
+		return FIT_INSIDE, nil
+	}
+
+	if !fits[v] {
+		return "", NewError(http.StatusBadRequest, "Illegal fit option '%v', expected `inside`, `contain`, `cover` or `fill`.", v)
+	}
+
+	return v, nil
+}
+
+// parseGravity accepts roi shortcuts, e.g. `center`, `ne` or `bright`, aliases are normalized.
+func parseGravity(v string) (string, error) {
+	if v == "" {
+		return "center", nil
+	}
+
+	gravity, found := canonicalGravity(v)
+	if !found {
+		return "", NewError(http.StatusBadRequest, "Illegal gravity `%s`", v)
+	}
+
+	return gravity, nil
+}
+
+// box returns both dimensions of scale, if they are given.
+func (this *Scale) box() (int, int, bool) {
+	if this == nil {
+		return 0, 0, false
+	}
+
+	return this.width, this.height, this.width > 0 && this.height > 0
+}
+
+// box returns both dimensions of scale multiplied by device pixel ratio.
+func (this *Options) box() (int, int, bool) {
+	w, h, ok := this.Scale.box()
+
+	return this.multiply(w), this.multiply(h), ok
+}
+
+// dpr returns device pixel ratio, options without it are 1x.
+func (this *Options) dpr() float64 {
+	if this.Dpr == 0 {
+		return 1
+	}
+
+	return this.Dpr
+}
+
+func (this *Options) multiply(v int) int {
+	return int(math.Floor(float64(v)*this.dpr() + 0.5))
+}
+
+// scaled multiplies the size, which is calculated by scale, by device pixel ratio.
+func (this *Options) scaled(zoom *PixelDim) *PixelDim {
+	if zoom == nil || this.dpr() == 1 {
+		return zoom
+	}
+
+	return &PixelDim{this.multiply(zoom.Width), this.multiply(zoom.Height)}
+}
+
+// fit returns the result size and the crop rectangle of area, which is cropped by roi already.
+func (this *Options) fit(area *PixelDim, roi *Rect) (*PixelDim, *Rect) {
+	w, h, _ := this.box()
+
+	switch this.Fit {
+	case FIT_FILL:
+		return &PixelDim{w, h}, roi
+
+	case FIT_CONTAIN:
+		return fitInside(area, w, h), roi
+
+	case FIT_COVER:
+		crop := &PixelDim{area.Width, int(math.Floor(float64(area.Width)*float64(h)/float64(w) + 0.5))}
+
+		if float64(area.Width)/float64(area.Height) > float64(w)/float64(h) {
+			crop = &PixelDim{int(math.Floor(float64(area.Height)*float64(w)/float64(h) + 0.5)), area.Height}
+		}
+
+		result := this.anchor(roi)(area.Width, area.Height, crop.Width, crop.Height)
+
+		if roi != nil {
+			result.X += roi.X
+			result.Y += roi.Y
+		}
+
+		return &PixelDim{w, h}, result
+	}
+
+	return fitInside(area, w, h), roi
+}
+
+// anchor positions cover crop by focal point, if it's given, otherwise by gravity.
+// The focal point is related to the source, so it's moved into the area, which is cropped by roi.
+func (this *Options) anchor(roi *Rect) func(int, int, int, int) *Rect {
+	if this.Focal == nil {
+		return handlers[this.gravity()]
+	}
+
+	if roi == nil {
+		return this.Focal.handler
+	}
+
+	size := this.Size()
+
+	focal := &Focal{
+		X: (this.Focal.X*float64(size.Width) - float64(roi.X)) / float64(roi.Width),
+		Y: (this.Focal.Y*float64(size.Height) - float64(roi.Y)) / float64(roi.Height),
+	}
+
+	return focal.handler
+}
+
+func (this *Options) gravity() string {
+	if this.Gravity == "" {
+		return "center"
+	}
+
+	return this.Gravity
+}
+
+// Canvas returns the result box and position of the image in it for `contain` fit, otherwise nil.
+func (this *Options) Canvas(zoom *PixelDim) *Rect {
+	w, h, ok := this.box()
+
+	if !ok || this.Fit != FIT_CONTAIN || zoom == nil {
+		return nil
+	}
+
+	position := handlers[this.gravity()](w, h, zoom.Width, zoom.Height)
+
+	return &Rect{position.X, position.Y, w, h}
+}
+
+// fitInside returns the biggest size of src aspect ratio, which is inside w x h box.
+func fitInside(src *PixelDim, w, h int) *PixelDim {
+	ratio := math.Min(float64(w)/float64(src.Width), float64(h)/float64(src.Height))
+
+	return &PixelDim{
+		Width:  int(math.Max(1, math.Floor(float64(src.Width)*ratio+0.5))),
+		Height: int(math.Max(1, math.Floor(float64(src.Height)*ratio+0.5))),
+	}
+}
+
+// capped returns zoom, if it's inside area, otherwise the biggest size of zoom aspect ratio inside area.
+func capped(zoom, area *PixelDim) *PixelDim {
+	if zoom.Width <= area.Width && zoom.Height <= area.Height {
+		return zoom
+	}
+
+	return fitInside(zoom, area.Width, area.Height)
+}
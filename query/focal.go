@@ -0,0 +1,62 @@
+package query
+
+import (
+	"math"
+	"strconv"
+)
+
+// Focal is a point of interest in normalized coordinates from 0 to 1, 0,0 is the top left corner.
+// If it's given, `crop` shortcuts and `cover` fit center the crop window on it as close as bounds allow.
+type Focal struct {
+	X float64
+	Y float64
+}
+
+// parseFocal returns nil, if neither coordinate is given, a missing one is the middle.
+func parseFocal(x, y string) (*Focal, error) {
+	if x == "" && y == "" {
+		return nil, nil
+	}
+
+	var err error
+
+	this := &Focal{}
+
+	if this.X, err = parseFloat("fp-x", x, 0.5, 0, 1); err != nil {
+		return nil, err
+	}
+
+	if this.Y, err = parseFloat("fp-y", y, 0.5, 0, 1); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+func (this *Focal) String() string {
+	return strconv.FormatFloat(this.X, 'f', -1, 64) + "," + strconv.FormatFloat(this.Y, 'f', -1, 64)
+}
+
+// handler is a roi handler, x,y are source dimensions, w,h are crop window dimensions.
+func (this *Focal) handler(x, y, w, h int) *Rect {
+	return &Rect{
+		X:      clamp(int(math.Floor(this.X*float64(x)-float64(w)/2+0.5)), x-w),
+		Y:      clamp(int(math.Floor(this.Y*float64(y)-float64(h)/2+0.5)), y-h),
+		Width:  w,
+		Height: h,
+	}
+}
+
+// clamp keeps offset v from 0 to max, a window bigger than the source is centered.
+func clamp(v, max int) int {
+	switch {
+	case max < 0:
+		return max / 2
+	case v < 0:
+		return 0
+	case v > max:
+		return max
+	}
+
+	return v
+}
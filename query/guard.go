@@ -0,0 +1,149 @@
+package query
+
+import (
+	"context"
+	"github.com/3d0c/imagio/config"
+	. "github.com/3d0c/imagio/utils"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+)
+
+// rules is a list of hosts and networks. Host `example.com` matches only itself,
+// `.example.com` or `*.example.com` match any subdomain.
+type rules struct {
+	hosts []string
+	nets  []*net.IPNet
+}
+
+func parseRules(list []string) *rules {
+	this := &rules{}
+
+	for _, item := range list {
+		if _, n, err := net.ParseCIDR(item); err == nil {
+			this.nets = append(this.nets, n)
+			continue
+		}
+
+		if ip := net.ParseIP(item); ip != nil {
+			this.nets = append(this.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+
+		this.hosts = append(this.hosts, strings.ToLower(strings.TrimPrefix(item, "*")))
+	}
+
+	return this
+}
+
+func (this *rules) matchHost(host string) bool {
+	host = strings.ToLower(host)
+
+	for _, pattern := range this.hosts {
+		if host == pattern || (strings.HasPrefix(pattern, ".") && strings.HasSuffix(host, pattern)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (this *rules) matchIP(ip net.IP) bool {
+	for _, n := range this.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkHost decides whether host, resolved to ips, could be used as origin.
+// Host is allowed if it isn't denied by name or by any of its addresses, and, if allow list
+// is defined, it's allowed by name or all of its addresses are allowed.
+func checkHost(host string, ips []net.IP) error {
+	allow := parseRules(config.Get().HttpAllow())
+	deny := parseRules(config.Get().HttpDeny())
+
+	if deny.matchHost(host) {
+		return NewError(http.StatusForbidden, "Source host `%s` is not allowed.", host)
+	}
+
+	for _, ip := range ips {
+		if deny.matchIP(ip) {
+			return NewError(http.StatusForbidden, "Source host `%s` (%v) is not allowed.", host, ip)
+		}
+	}
+
+	if len(config.Get().HttpAllow()) == 0 || allow.matchHost(host) {
+		return nil
+	}
+
+	for _, ip := range ips {
+		if !allow.matchIP(ip) {
+			return NewError(http.StatusForbidden, "Source host `%s` (%v) is not in allowed list.", host, ip)
+		}
+	}
+
+	return nil
+}
+
+// guardedDial resolves address itself and connects only to checked IPs,
+// so DNS rebinding can't bypass the rules. It's used for redirects as well.
+func guardedDial(ctx context.Context, network, address string) (net.Conn, error) {
+	var conn net.Conn
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+
+	if err = checkHost(host, ips); err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: config.Get().ConnectTimeout("http")}
+
+	for _, ip := range ips {
+		if conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, err
+}
+
+// guardedTransport re-checks keep-alive connections, which were dialed with other rules.
+// Such a connection is closed before the request is written, so the request is retried
+// on a new connection, which is checked by guardedDial.
+type guardedTransport struct {
+	*http.Transport
+}
+
+func (this *guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if !info.Reused {
+				return
+			}
+
+			addr, ok := info.Conn.RemoteAddr().(*net.TCPAddr)
+			if !ok || checkHost(req.URL.Hostname(), []net.IP{addr.IP}) != nil {
+				info.Conn.Close()
+			}
+		},
+	}
+
+	return this.Transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+}
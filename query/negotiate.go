@@ -0,0 +1,84 @@
+package query
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Format, which is chosen by the Accept header and by the source.
+const AUTO = "auto"
+
+// Negotiate resolves `auto` format for the Accept header. It only remembers, whether WebP is accepted
+// explicitly, the format is resolved by the source on Load(): gif for gif sources to keep animation,
+// then webp, if it's accepted, png for sources with alpha channel and jpeg for the rest.
+// It returns true, if the result depends on the Accept header.
+func (this *Options) Negotiate(accept string) bool {
+	if this.Format != AUTO {
+		return false
+	}
+
+	this.AcceptWebp = accepts(accept, mimeTypes["webp"])
+
+	return true
+}
+
+// resolveAuto is called, when the source is loaded. Gif stays gif to keep animation.
+func (this *Options) resolveAuto() {
+	if this.Format != AUTO || this.Base == nil {
+		return
+	}
+
+	switch {
+	case this.Base.Type() == "gif" && !this.FirstFrame:
+		this.Format = "gif"
+
+	case this.AcceptWebp:
+		this.Format = "webp"
+
+	case this.Base.HasAlpha():
+		this.Format = "png"
+
+	default:
+		this.Format = "jpeg"
+	}
+}
+
+// accepts reports whether mimeType is listed in the Accept header with non-zero quality.
+// Wildcards are ignored, browsers send `*/*` regardless of image formats they support.
+func accepts(accept, mimeType string) bool {
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+
+		if !strings.EqualFold(strings.TrimSpace(params[0]), mimeType) {
+			continue
+		}
+
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q <= 0 {
+					return false
+				}
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// FormatOf detects the format of encoded image, e.g. of the result for `auto` format.
+func FormatOf(data []byte) string {
+	mimeType := http.DetectContentType(data)
+
+	for format, m := range mimeTypes {
+		if m == mimeType {
+			return format
+		}
+	}
+
+	return ""
+}
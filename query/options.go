@@ -1,28 +1,50 @@
 package query
 
 import (
+	"fmt"
 	"github.com/3d0c/imagio/config"
 	. "github.com/3d0c/imagio/utils"
 	"log"
+	"math"
+	"net/http"
 	"net/url"
 	"reflect"
 	"strconv"
 )
 
 var supportedOptions = map[string]interface{}{
-	"jpeg": "jpeg", "jpg": "jpeg", "png": "png", "gif": "gif", "json": "json",
+	"jpeg": "jpeg", "jpg": "jpeg", "png": "png", "gif": "gif", "webp": "webp", "json": "json", "auto": AUTO,
 	"NN": 1, "LINEAR": 2, "CUBIC": 3, "AREA": 4, "LANCZOS": 5,
 	"true": true, "false": false, "alpha": 0.5,
 }
 
+// Output formats, which keep alpha channel.
+var alphaFormats = map[string]bool{"png": true, "webp": true, AUTO: true}
+
+var mimeTypes = map[string]string{
+	"jpeg": "image/jpeg", "png": "image/png", "gif": "image/gif", "webp": "image/webp", "json": "application/json",
+}
+
 type Options struct {
 	Base       *Source
 	Scale      *Scale
 	CropRoi    *Roi
+	Fit        string
+	Gravity    string
+	Focal      *Focal
+	Dpr        float64
+	NoUpscale  bool
+	Rotate     float64
+	Flip       int
+	Fill       *Color
 	Format     string
 	Method     int
 	Quality    int
+	Lossless   bool
+	FirstFrame bool
+	AcceptWebp bool
 	Alpha      float64
+	Background *Color
 	Foreground *Source
 	Mask       *Source
 	BlendRoi   *Roi
@@ -34,8 +56,19 @@ func (*Options) Construct(i ...interface{}) *Options {
 		return nil
 	}
 
-	v := i[0].([]interface{})[0]
+	this, err := Parse(i[0].([]interface{})[0])
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
 
+	return this
+}
+
+// Parse builds Options from *url.URL or from a string, which could be parsed as URL.
+// Returned error is an *Error, which carries the HTTP status to respond with.
+// Sources are not fetched, see Load().
+func Parse(v interface{}) (*Options, error) {
 	switch v.(type) {
 	case *url.URL:
 		return parseQuery(v.(*url.URL))
@@ -43,61 +76,410 @@ func (*Options) Construct(i ...interface{}) *Options {
 	case string:
 		u, err := url.Parse(v.(string))
 		if err != nil {
-			log.Println("Unable to parse query:", v)
-			return nil
+			return nil, NewError(http.StatusBadRequest, "Unable to parse query: %v", v)
 		}
 
 		return parseQuery(u)
-		break
+	}
+
+	return nil, NewError(http.StatusInternalServerError, "Unsupported type: %v", reflect.TypeOf(v))
+}
+
+// Size returns dimensions of the source after rotation, flip doesn't change them.
+func (this *Options) Size() *PixelDim {
+	return rotated(this.Base.Size(), this.Rotate)
+}
+
+// Geometry returns crop rectangle and the result dimensions. If both crop and scale options are given,
+// crop will be first, the scale size will be calculated from cropped dimension.
+// Rotation and flip are applied before crop, so crop coordinates are coordinates of the rotated image.
+// zoom is nil, if only crop is required, roi is nil, if there is nothing to crop.
+// The result dimensions are checked against configured limits.
+func (this *Options) Geometry() (zoom *PixelDim, roi *Rect, err error) {
+	size := this.Size()
+
+	if this.CropRoi != nil {
+		roi = this.CropRoi.Calc(size)
+	}
+
+	_, _, box := this.box()
+
+	switch {
+	case box && roi != nil:
+		zoom, roi = this.fit(&PixelDim{roi.Width, roi.Height}, roi)
+
+	case box:
+		zoom, roi = this.fit(size, nil)
+
+	case roi != nil && this.Scale != nil:
+		zoom = this.scaled(this.Scale.Size(&PixelDim{roi.Width, roi.Height}))
+
+	case this.Scale != nil:
+		zoom = this.scaled(this.Scale.Size(size))
+
+	case roi == nil:
+		zoom = size
+	}
+
+	// the image isn't enlarged beyond the area it's scaled from, dpr included
+	if zoom != nil && this.Scale != nil && (this.NoUpscale || (box && this.Fit == FIT_INSIDE)) {
+		area := size
+		if roi != nil {
+			area = &PixelDim{roi.Width, roi.Height}
+		}
+
+		zoom = capped(zoom, area)
+	}
+
+	result := zoom
+
+	if result == nil && roi != nil {
+		result = &PixelDim{roi.Width, roi.Height}
+	}
+
+	if canvas := this.Canvas(zoom); canvas != nil {
+		result = &PixelDim{canvas.Width, canvas.Height}
+	}
+
+	if result == nil || result.Width <= 0 || result.Height <= 0 {
+		return nil, nil, NewError(http.StatusUnprocessableEntity, "Unable to calculate result dimensions for %v.", this.Base.Key())
+	}
+
+	if result.Width > config.Get().MaxWidth() || result.Height > config.Get().MaxHeight() {
+		return nil, nil, NewError(http.StatusUnprocessableEntity, "Result dimensions %dx%d exceed maximum %dx%d.", result.Width, result.Height, config.Get().MaxWidth(), config.Get().MaxHeight())
+	}
+
+	return zoom, roi, nil
+}
+
+// ParseKey builds Options back from the Key().
+func ParseKey(key string) (*Options, error) {
+	query, err := url.ParseQuery(key)
+	if err != nil {
+		return nil, NewError(http.StatusBadRequest, "Unable to parse key: %v", key)
+	}
+
+	return parseValues(query)
+}
+
+// Key returns a canonical representation of options. Options are sorted, defaults are resolved
+// and source references are normalized, so equal transformations have equal keys.
+func (this *Options) Key() string {
+	query := url.Values{}
+
+	query.Set("format", this.Format)
+	query.Set("method", strconv.Itoa(this.Method))
+	query.Set("quality", strconv.Itoa(this.Quality))
+
+	// only webp could be lossless
+	if this.Lossless && (this.Format == "webp" || (this.Format == AUTO && this.AcceptWebp)) {
+		query.Set("lossless", "true")
+	}
+
+	if this.Base != nil {
+		query.Set("source", this.Base.Key())
+	}
+
+	if this.Scale != nil {
+		query.Set("scale", this.Scale.String())
+	}
+
+	_, _, box := this.Scale.box()
+
+	// dpr and enlarge make sense only for scale, inside fit never enlarges anyway
+	if this.Scale != nil && this.dpr() != 1 {
+		query.Set("dpr", strconv.FormatFloat(this.dpr(), 'f', -1, 64))
+	}
+
+	// the default is configurable, so the key keeps it explicitly
+	if this.Scale != nil && !(box && this.Fit == FIT_INSIDE) {
+		query.Set("enlarge", strconv.FormatBool(!this.NoUpscale))
+	}
+
+	// fit makes sense only for both dimensions, gravity only for cover and contain
+	if box {
+		query.Set("fit", this.Fit)
+
+		if (this.Fit == FIT_COVER && this.Focal == nil) || this.Fit == FIT_CONTAIN {
+			query.Set("gravity", this.gravity())
+		}
+	}
+
+	if this.CropRoi != nil {
+		query.Set("crop", this.CropRoi.String())
+	}
+
+	// focal point makes sense only for crop shortcuts and cover
+	if this.Focal != nil && ((this.CropRoi != nil && this.CropRoi.gravity != "") || (box && this.Fit == FIT_COVER)) {
+		query.Set("fp-x", strconv.FormatFloat(this.Focal.X, 'f', -1, 64))
+		query.Set("fp-y", strconv.FormatFloat(this.Focal.Y, 'f', -1, 64))
+	}
+
+	if this.Rotate != 0 {
+		query.Set("rotate", strconv.FormatFloat(this.Rotate, 'f', -1, 64))
+	}
+
+	// fill makes sense only for arbitrary angles and for padding
+	if this.Fill != nil && (!rightAngle(this.Rotate) || (box && this.Fit == FIT_CONTAIN)) {
+		query.Set("fill", this.Fill.String())
+	}
+
+	if this.Flip != 0 {
+		query.Set("flip", flipNames[this.Flip])
+	}
+
+	if this.FirstFrame {
+		query.Set("first_frame", "true")
+	}
+
+	// negotiated by the Accept header
+	if this.AcceptWebp && this.Format == AUTO {
+		query.Set("accept_webp", "true")
+	}
+
+	// background makes sense only for formats without alpha
+	if this.Flatten() && this.Background != nil {
+		query.Set("background", this.Background.String())
+	}
+
+	// blending options make sense only with a foreground
+	if this.Foreground != nil {
+		query.Set("blend_alpha", strconv.FormatFloat(this.Alpha, 'f', -1, 64))
+		query.Set("blend_with", this.Foreground.Key())
+
+		if this.Mask != nil {
+			query.Set("blend_mask", this.Mask.Key())
+		}
+
+		if this.BlendRoi != nil {
+			query.Set("blend_roi", this.BlendRoi.String())
+		}
+	}
+
+	return query.Encode()
+}
+
+// Flatten reports whether images with alpha channel should be composed over the background.
+func (this *Options) Flatten() bool {
+	return !alphaFormats[this.Format]
+}
+
+// Load fetches all sources and resolves `auto` format, which wasn't negotiated.
+func (this *Options) Load() error {
+	for _, src := range []*Source{this.Base, this.Foreground, this.Mask} {
+		if src == nil {
+			continue
+		}
 
-	default:
-		log.Println("Unsupported type:", reflect.TypeOf(v))
+		if err := src.Load(); err != nil {
+			return err
+		}
 	}
 
+	this.resolveAuto()
+
 	return nil
 }
 
-func parseQuery(u *url.URL) *Options {
-	query := u.Query()
+func parseQuery(u *url.URL) (*Options, error) {
 	log.Println("in:", u.String())
-	this := &Options{
-		CropRoi: Construct(new(Roi), query.Get("crop")).(*Roi),
-		Scale:   Construct(new(Scale), query.Get("scale")).(*Scale),
-		Base:    Construct(new(Source), query.Get("source")).(*Source),
 
-		Format:  get(query.Get("format"), config.Get().Format()).(string),
-		Method:  get(query.Get("method"), config.Get().Method()).(int),
-		Alpha:   getFloat(query.Get("blend_alpha"), config.Get().Alpha()),
-		Quality: getInt(query.Get("quality"), config.Get().Quality()),
+	// negotiation result is a part of the key only, it comes from the Accept header
+	query := u.Query()
+	query.Del("accept_webp")
 
-		Foreground: Construct(new(Source), config.Get().BlendWith(query.Get("blend_with"))).(*Source),
-		Mask:       Construct(new(Source), config.Get().BlendMask(query.Get("blend_mask"))).(*Source),
-		BlendRoi:   Construct(new(Roi), config.Get().BlendRoi(query.Get("blend_roi"))).(*Roi),
+	return parseValues(query)
+}
+
+func parseValues(query url.Values) (*Options, error) {
+	var err error
+
+	if query.Get("source") == "" {
+		return nil, NewError(http.StatusBadRequest, "Option `source` is required.")
 	}
 
-	return this
+	this := &Options{}
+
+	if this.Format, err = parseFormat(query.Get("format")); err != nil {
+		return nil, err
+	}
+
+	if this.Method, err = parseMethod(query.Get("method")); err != nil {
+		return nil, err
+	}
+
+	if this.Quality, err = parseInt("quality", query.Get("quality"), config.Get().Quality(), 0, 100); err != nil {
+		return nil, err
+	}
+
+	if this.Lossless, err = parseBool("lossless", query.Get("lossless"), false); err != nil {
+		return nil, err
+	}
+
+	if this.FirstFrame, err = parseBool("first_frame", query.Get("first_frame"), false); err != nil {
+		return nil, err
+	}
+
+	if this.AcceptWebp, err = parseBool("accept_webp", query.Get("accept_webp"), false); err != nil {
+		return nil, err
+	}
+
+	if this.Alpha, err = parseFloat("blend_alpha", query.Get("blend_alpha"), config.Get().Alpha(), 0, 1); err != nil {
+		return nil, err
+	}
+
+	if this.Background, err = parseColor(config.Get().Background(query.Get("background"))); err != nil {
+		return nil, err
+	}
+
+	if this.CropRoi, err = parseRoi(query.Get("crop")); err != nil {
+		return nil, err
+	}
+
+	if this.Scale, err = parseScale(query.Get("scale")); err != nil {
+		return nil, err
+	}
+
+	if this.Fit, err = parseFit(query.Get("fit")); err != nil {
+		return nil, err
+	}
+
+	if this.Gravity, err = parseGravity(query.Get("gravity")); err != nil {
+		return nil, err
+	}
+
+	if this.Focal, err = parseFocal(query.Get("fp-x"), query.Get("fp-y")); err != nil {
+		return nil, err
+	}
+
+	if this.CropRoi != nil {
+		this.CropRoi.focal = this.Focal
+	}
+
+	enlarge, err := parseBool("enlarge", query.Get("enlarge"), config.Get().Enlarge())
+	if err != nil {
+		return nil, err
+	}
+
+	this.NoUpscale = !enlarge
+
+	if this.Dpr, err = parseFloat("dpr", query.Get("dpr"), 1, 1, 4); err != nil {
+		return nil, err
+	}
+
+	if this.Rotate, err = parseRotate(query.Get("rotate")); err != nil {
+		return nil, err
+	}
+
+	if this.Flip, err = parseFlip(query.Get("flip")); err != nil {
+		return nil, err
+	}
+
+	// corners of rotated image and padding are filled with the background by default
+	if this.Fill, err = parseColor(config.Get().Background(query.Get("fill"))); err != nil {
+		return nil, err
+	}
+
+	if this.BlendRoi, err = parseRoi(config.Get().BlendRoi(query.Get("blend_roi"))); err != nil {
+		return nil, err
+	}
+
+	if this.Base, err = new(Source).fromUrl(query.Get("source")); err != nil {
+		return nil, err
+	}
+
+	if this.Foreground, err = new(Source).fromUrl(config.Get().BlendWith(query.Get("blend_with"))); err != nil {
+		return nil, err
+	}
+
+	if this.Mask, err = new(Source).fromUrl(config.Get().BlendMask(query.Get("blend_mask"))); err != nil {
+		return nil, err
+	}
+
+	return this, nil
 }
 
-func get(key string, def interface{}) interface{} {
-	if val, found := supportedOptions[key]; found {
-		return val
+// MimeType returns Content-Type for the result format.
+func MimeType(format string) string {
+	if mimeType, found := mimeTypes[format]; found {
+		return mimeType
 	}
 
-	return def
+	return "application/octet-stream"
 }
 
-func getFloat(key string, def float64) float64 {
-	if val, err := strconv.ParseFloat(key, 64); err == nil {
-		return val
+// parseFormat normalizes format or the default one, e.g. `jpg` to `jpeg`.
+func parseFormat(key string) (string, error) {
+	if key == "" {
+		key = config.Get().Format()
 	}
 
-	return def
+	if format, ok := supportedOptions[key].(string); ok {
+		return format, nil
+	}
+
+	return "", NewError(http.StatusBadRequest, "Unsupported format `%s`", key)
 }
 
-func getInt(key string, def int) int {
-	if val, err := strconv.Atoi(key); err == nil {
-		return val
+// CheckDefaults validates defaults of config, so a wrong one fails on start instead of every request.
+func CheckDefaults() error {
+	if _, err := parseFormat(""); err != nil {
+		return fmt.Errorf("Wrong default format. %v", err)
+	}
+
+	return nil
+}
+
+func parseMethod(key string) (int, error) {
+	if key == "" {
+		return config.Get().Method(), nil
+	}
+
+	if method, ok := supportedOptions[key].(int); ok {
+		return method, nil
+	}
+
+	if method, err := strconv.Atoi(key); err == nil && method >= 1 && method <= 5 {
+		return method, nil
+	}
+
+	return 0, NewError(http.StatusBadRequest, "Unsupported method `%s`", key)
+}
+
+func parseInt(name, key string, def, min, max int) (int, error) {
+	if key == "" {
+		return def, nil
+	}
+
+	val, err := strconv.Atoi(key)
+	if err != nil || val < min || val > max {
+		return 0, NewError(http.StatusBadRequest, "Option `%s` should be an integer from %d to %d, `%s` given.", name, min, max, key)
+	}
+
+	return val, nil
+}
+
+func parseBool(name, key string, def bool) (bool, error) {
+	if key == "" {
+		return def, nil
+	}
+
+	if val, ok := supportedOptions[key].(bool); ok {
+		return val, nil
+	}
+
+	return false, NewError(http.StatusBadRequest, "Option `%s` should be `true` or `false`, `%s` given.", name, key)
+}
+
+func parseFloat(name, key string, def, min, max float64) (float64, error) {
+	if key == "" {
+		return def, nil
+	}
+
+	val, err := strconv.ParseFloat(key, 64)
+	if err != nil || math.IsNaN(val) || math.IsInf(val, 0) || val < min || val > max {
+		return 0, NewError(http.StatusBadRequest, "Option `%s` should be a number from %v to %v, `%s` given.", name, min, max, key)
 	}
 
-	return def
+	return val, nil
 }
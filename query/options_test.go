@@ -3,15 +3,26 @@ package query
 import (
 	"bytes"
 	"compress/gzip"
+	"encoding/binary"
 	"encoding/hex"
 	"github.com/3d0c/imagio/config"
 	. "github.com/3d0c/imagio/utils"
+	"github.com/golang/groupcache"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -39,17 +50,37 @@ func getJpeg() []byte {
 	return data
 }
 
+var downloads int32
+
 func serveJpeg() {
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeContent(w, r, file_name, time.Now(), bytes.NewReader(getJpeg()))
 	})
 
+	http.HandleFunc("/slow/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		http.ServeContent(w, r, file_name, time.Now(), bytes.NewReader(getJpeg()))
+	})
+
+	http.HandleFunc("/counted/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&downloads, 1)
+		time.Sleep(200 * time.Millisecond)
+		http.ServeContent(w, r, file_name, time.Now(), bytes.NewReader(getJpeg()))
+	})
+
+	http.HandleFunc("/broken/", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	})
+
 	log.Fatal(http.ListenAndServe(test_server, nil))
 }
 
 func init() {
 	go serveJpeg()
 
+	// test server is on localhost, which is denied by default
+	config.Get().Sources.Http.Deny = []string{}
+
 	tmp, err := os.Create("/tmp/1024x768.jpg")
 	if err != nil {
 		log.Fatalf("Unable to create testing content, /tmp/1024x768.jpg. %v\n", err)
@@ -147,14 +178,26 @@ func TestRoi(t *testing.T) {
 	original := &PixelDim{Width: 1024, Height: 768}
 
 	cases := map[string]*Rect{
-		"":               nil,
-		"1,1,500,500":    &Rect{1, 1, 500, 500},
-		"left,500,500":   &Rect{0, 0, 500, 500},
-		"right,500,500":  &Rect{524, 0, 500, 500},
-		"bleft,500,500":  &Rect{0, 268, 500, 500},
-		"bright,500,500": &Rect{524, 268, 500, 500},
-		"center,500,500": &Rect{262, 134, 500, 500},
-		"500,500":        &Rect{500, 500, 0, 0},
+		"":                nil,
+		"1,1,500,500":     &Rect{1, 1, 500, 500},
+		"left,500,500":    &Rect{0, 0, 500, 500},
+		"right,500,500":   &Rect{524, 0, 500, 500},
+		"bleft,500,500":   &Rect{0, 268, 500, 500},
+		"bright,500,500":  &Rect{524, 268, 500, 500},
+		"center,500,500":  &Rect{262, 134, 500, 500},
+		"500,500":         &Rect{500, 500, 0, 0},
+		"n,500,500":       &Rect{262, 0, 500, 500},
+		"top,500,500":     &Rect{262, 0, 500, 500},
+		"s,500,500":       &Rect{262, 268, 500, 500},
+		"w,500,500":       &Rect{0, 134, 500, 500},
+		"e,500,500":       &Rect{524, 134, 500, 500},
+		"ne,500,500":      &Rect{524, 0, 500, 500},
+		"sw,500,500":      &Rect{0, 268, 500, 500},
+		"10%,10%,80%,80%": &Rect{102, 77, 819, 614},
+		"50%,0,100,100":   &Rect{512, 0, 100, 100},
+		"center,50%,50%":  &Rect{256, 192, 512, 384},
+		"se,25%,200":      &Rect{768, 568, 256, 200},
+		"25%,50%":         &Rect{256, 384, 0, 0},
 	}
 
 	for opt, expected := range cases {
@@ -172,3 +215,862 @@ func TestRoi(t *testing.T) {
 		}
 	}
 }
+
+func TestParseErrors(t *testing.T) {
+	cfg := config.Get()
+	cfg.Sources.File.Root = "/tmp"
+
+	if err := ioutil.WriteFile("/tmp/imagio-not-an-image.txt", []byte("plain text"), 0644); err != nil {
+		t.Fatalf("Unable to create testing content. %v\n", err)
+	}
+
+	base := "/?source=http://" + test_server + "/" + file_name
+
+	cases := map[string]int{
+		"/?scale=800x":                            http.StatusBadRequest,
+		base + "&crop=a,b,c,d":                    http.StatusBadRequest,
+		base + "&crop=up,500,500":                 http.StatusBadRequest,
+		base + "&scale=large":                     http.StatusBadRequest,
+		base + "&scale=NaN":                       http.StatusBadRequest,
+		base + "&scale=Inf":                       http.StatusBadRequest,
+		base + "&scale=3e10":                      http.StatusBadRequest,
+		base + "&quality=101":                     http.StatusBadRequest,
+		base + "&format=bmp":                      http.StatusBadRequest,
+		base + "&method=NEAREST":                  http.StatusBadRequest,
+		base + "&background=white":                http.StatusBadRequest,
+		base + "&format=webp&lossless=yes":        http.StatusBadRequest,
+		base + "&first_frame=1":                   http.StatusBadRequest,
+		base + "&rotate=left":                     http.StatusBadRequest,
+		base + "&flip=x":                          http.StatusBadRequest,
+		base + "&scale=300x300&fit=stretch":       http.StatusBadRequest,
+		base + "&scale=300x300&gravity=middle":    http.StatusBadRequest,
+		base + "&scale=300x&dpr=5":                http.StatusBadRequest,
+		base + "&scale=300x&dpr=NaN":              http.StatusBadRequest,
+		base + "&blend_alpha=NaN":                 http.StatusBadRequest,
+		base + "&crop=center,50,50&fp-x=NaN":      http.StatusBadRequest,
+		base + "&crop=center,50,50&fp-y=-Inf":     http.StatusBadRequest,
+		base + "&scale=300x&enlarge=no":           http.StatusBadRequest,
+		base + "&crop=0,0,150%25,50%25":           http.StatusBadRequest,
+		base + "&crop=center,-5%25,50%25":         http.StatusBadRequest,
+		base + "&crop=center,NaN%25,50%25":        http.StatusBadRequest,
+		base + "&crop=0,0,Inf%25,50%25":           http.StatusBadRequest,
+		base + "&crop=center,50,50&fp-x=2":        http.StatusBadRequest,
+		base + "&crop=center,50,50&fp-y=top":      http.StatusBadRequest,
+		base + "&crop=middle,50%25,50%25":         http.StatusBadRequest,
+		"/?source=ftp://host/1.jpg":               http.StatusBadRequest,
+		"/?source=file://imagio-not-found.jpg":    http.StatusNotFound,
+		"/?source=file://imagio-not-an-image.txt": http.StatusUnsupportedMediaType,
+		"/?source=http://localhost:1/1.jpg":       http.StatusBadGateway,
+	}
+
+	for query, want := range cases {
+		o, err := Parse(query)
+		if err == nil {
+			err = o.Load()
+		}
+
+		if err == nil {
+			t.Errorf("Expected error for %v, got %v\n", query, o)
+			continue
+		}
+
+		if StatusOf(err) != want {
+			t.Errorf("Expected status for %v is %v, got %v. %v\n", query, want, StatusOf(err), err)
+		}
+
+		// messages are shown to clients, the root shouldn't be there
+		if strings.Contains(err.Error(), "/tmp") {
+			t.Errorf("Expected error for %v without root, got %v\n", query, err)
+		}
+	}
+
+	if _, err := Parse(base + "&crop=center,500,500&scale=800x&method=2"); err != nil {
+		t.Errorf("Expected valid options, got %v\n", err)
+	}
+}
+
+func TestDefaultFormat(t *testing.T) {
+	cfg := config.Get()
+	defer func(format string) { cfg.Defaults.Format = format }(cfg.Defaults.Format)
+
+	cfg.Defaults.Format = "jpg"
+
+	a, _ := Parse("/?source=1.jpg&scale=800x")
+	b, _ := Parse("/?source=1.jpg&scale=800x&format=jpeg")
+
+	if a.Format != "jpeg" || a.Key() != b.Key() {
+		t.Errorf("Expected default format is normalized to jpeg, got %v, %v\n", a.Format, a.Key())
+	}
+
+	if err := CheckDefaults(); err != nil {
+		t.Errorf("Unexpected error for valid default format. %v\n", err)
+	}
+
+	cfg.Defaults.Format = "bmp"
+
+	if err := CheckDefaults(); err == nil {
+		t.Errorf("Expected error for wrong default format\n")
+	}
+}
+
+func TestKey(t *testing.T) {
+	config.Get().Sources.File.Root = "/tmp"
+
+	cases := [][]string{
+		{
+			"/?source=http://" + test_server + "/" + file_name + "&scale=800x&quality=80",
+			"/?quality=80&scale=800x&source=" + test_server + "//" + file_name + "&format=jpeg",
+			"/?scale=800x&format=jpg&source=http://" + test_server + "/./" + file_name,
+		},
+		{
+			"/?source=file://1.jpg&crop=center,500,500&method=3",
+			"/?crop=center,500,500&source=file://1.jpg&method=CUBIC",
+		},
+		{
+			"/?source=file://1.jpg&background=FFF",
+			"/?source=file://1.jpg&background=%23ffffff",
+			"/?source=file://1.jpg",
+		},
+		{
+			"/?source=file://1.jpg&format=png&background=000",
+			"/?source=file://1.jpg&format=png",
+		},
+		{
+			"/?source=file://1.jpg&rotate=90&flip=horizontal&fill=000",
+			"/?source=file://1.jpg&rotate=-270&flip=h",
+			"/?source=file://1.jpg&rotate=450&flip=h",
+		},
+		{
+			"/?source=file://1.jpg&scale=800x600",
+			"/?source=file://1.jpg&scale=800x600&fit=inside&gravity=left",
+		},
+		{
+			"/?source=file://1.jpg&scale=800x&fit=cover",
+			"/?source=file://1.jpg&scale=800x",
+		},
+		{
+			"/?source=file://1.jpg&scale=800x600&fit=cover",
+			"/?source=file://1.jpg&scale=800x600&fit=cover&gravity=center&fill=000",
+		},
+		{
+			"/?source=file://1.jpg&rotate=360",
+			"/?source=file://1.jpg",
+		},
+		{
+			"/?source=file://1.jpg&rotate=45",
+			"/?source=file://1.jpg&rotate=45&fill=ffffff",
+		},
+		{
+			"/?source=file://1.jpg&lossless=true",
+			"/?source=file://1.jpg&lossless=false",
+		},
+		{
+			"/?source=file://1.jpg&format=webp&lossless=true&background=000",
+			"/?source=file://1.jpg&format=webp&lossless=true",
+		},
+		{
+			"/?source=file://1.jpg&crop=bright,500,500&blend_roi=top,10,10",
+			"/?source=file://1.jpg&crop=se,500,500&blend_roi=n,10,10",
+		},
+		{
+			"/?source=file://1.jpg&scale=300x300&fit=cover&gravity=left-center",
+			"/?source=file://1.jpg&scale=300x300&fit=cover&gravity=w",
+		},
+		{
+			"/?source=file://1.jpg&crop=10%25,10.0%25,80%25,80%25",
+			"/?source=file://1.jpg&crop=10%25,10%25,80%25,80%25",
+		},
+		{
+			"/?source=file://1.jpg&crop=ne,500,500&fp-x=0.3",
+			"/?source=file://1.jpg&crop=center,500,500&fp-x=.3&fp-y=0.5",
+		},
+		{
+			"/?source=file://1.jpg&scale=300x300&fit=cover&gravity=left&fp-x=0.3",
+			"/?source=file://1.jpg&scale=300x300&fit=cover&fp-x=0.3&fp-y=0.5",
+		},
+		{
+			"/?source=file://1.jpg&crop=10,10,100,100&fp-x=0.3",
+			"/?source=file://1.jpg&crop=10,10,100,100",
+		},
+		{
+			"/?source=file://1.jpg&scale=800x&dpr=1",
+			"/?source=file://1.jpg&scale=800x&enlarge=true",
+		},
+		{
+			"/?source=file://1.jpg&dpr=2&enlarge=false",
+			"/?source=file://1.jpg",
+		},
+		{
+			"/?source=file://1.jpg&scale=800x600&enlarge=false",
+			"/?source=file://1.jpg&scale=800x600",
+		},
+	}
+
+	for _, equal := range cases {
+		var key string
+
+		for _, query := range equal {
+			o, err := Parse(query)
+			if err != nil {
+				t.Fatalf("Unable to parse %v. %v\n", query, err)
+			}
+
+			if key != "" && o.Key() != key {
+				t.Errorf("Expected key for %v is %v, got %v\n", query, key, o.Key())
+			}
+
+			key = o.Key()
+
+			back, err := ParseKey(key)
+			if err != nil {
+				t.Fatalf("Unable to parse key %v. %v\n", key, err)
+			}
+
+			if back.Key() != key {
+				t.Errorf("Expected round-trip key is %v, got %v\n", key, back.Key())
+			}
+		}
+	}
+
+	a, _ := Parse("/?source=1.jpg&scale=800x")
+	b, _ := Parse("/?source=1.jpg&scale=x800")
+
+	if a.Key() == b.Key() {
+		t.Errorf("Expected different keys for different scales, got %v\n", a.Key())
+	}
+
+	a, _ = Parse("/?source=1.jpg&scale=800x&dpr=2")
+	b, _ = Parse("/?source=1.jpg&scale=800x&enlarge=false")
+
+	if a.Key() == b.Key() || b.Key() == (&Options{Base: b.Base, Scale: b.Scale, Format: b.Format, Method: b.Method, Quality: b.Quality}).Key() {
+		t.Errorf("Expected different keys for dpr and enlarge, got %v\n", a.Key())
+	}
+
+	a, _ = Parse("/?source=1.jpg&background=000")
+	b, _ = Parse("/?source=1.jpg&background=fff")
+
+	if a.Key() == b.Key() {
+		t.Errorf("Expected different keys for different backgrounds, got %v\n", a.Key())
+	}
+}
+
+func TestGuard(t *testing.T) {
+	cfg := config.Get()
+
+	defer func() {
+		cfg.Sources.Http.Allow = nil
+		cfg.Sources.Http.Deny = []string{}
+	}()
+
+	link := "http://" + test_server + "/" + file_name
+
+	cases := []struct {
+		allow  []string
+		deny   []string
+		status int
+	}{
+		{nil, nil, http.StatusForbidden},
+		{nil, []string{"127.0.0.1"}, http.StatusForbidden},
+		{nil, []string{"LOCALHOST"}, http.StatusForbidden},
+		{[]string{"example.com"}, []string{}, http.StatusForbidden},
+		{[]string{"*.example.com", "localhost"}, []string{}, 0},
+		{[]string{"127.0.0.0/8", "::1"}, []string{}, 0},
+		{[]string{}, []string{"10.0.0.0/8"}, 0},
+		// keep-alive connection of the previous case isn't reused
+		{nil, []string{"127.0.0.1"}, http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		cfg.Sources.Http.Allow = c.allow
+		cfg.Sources.Http.Deny = c.deny
+
+		o, err := Parse("/?source=" + link)
+		if err == nil {
+			err = o.Load()
+		}
+
+		if c.status == 0 && err != nil {
+			t.Errorf("Expected %v is allowed with allow=%v, deny=%v. %v\n", link, c.allow, c.deny, err)
+		}
+
+		if c.status != 0 && StatusOf(err) != c.status {
+			t.Errorf("Expected status %v with allow=%v, deny=%v, got %v\n", c.status, c.allow, c.deny, err)
+		}
+	}
+}
+
+func TestFetchLimits(t *testing.T) {
+	cfg := config.Get()
+
+	defer func() {
+		cfg.Sources.Http.ReadTimeout = ""
+		cfg.Sources.Http.MaxSize = ""
+	}()
+
+	cases := []struct {
+		link    string
+		timeout string
+		size    string
+		status  int
+	}{
+		{"/slow/" + file_name, "100ms", "", http.StatusGatewayTimeout},
+		{"/slow/" + file_name, "5s", "", 0},
+		{"/" + file_name, "", "1K", http.StatusRequestEntityTooLarge},
+		{"/broken/" + file_name, "", "", http.StatusBadGateway},
+	}
+
+	for _, c := range cases {
+		cfg.Sources.Http.ReadTimeout = c.timeout
+		cfg.Sources.Http.MaxSize = c.size
+
+		o, err := Parse("/?source=http://" + test_server + c.link)
+		if err == nil {
+			err = o.Load()
+		}
+
+		if c.status == 0 && err != nil {
+			t.Errorf("Expected %v is loaded, got %v\n", c.link, err)
+		}
+
+		if c.status != 0 && StatusOf(err) != c.status {
+			t.Errorf("Expected status %v for %v, got %v\n", c.status, c.link, err)
+		}
+	}
+}
+
+func TestFetchDedup(t *testing.T) {
+	var wg sync.WaitGroup
+
+	atomic.StoreInt32(&downloads, 0)
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			o, err := Parse("/?source=http://" + test_server + "/counted/" + file_name)
+			if err == nil {
+				err = o.Load()
+			}
+
+			if err != nil {
+				t.Errorf("Expected source is loaded, got %v\n", err)
+				return
+			}
+
+			if o.Base.Size().Width != 1024 {
+				t.Errorf("Expected width 1024, got %v\n", o.Base.Size().Width)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("Expected 1 download, got %v\n", n)
+	}
+}
+
+func TestSourceGroup(t *testing.T) {
+	// groups can't be registered twice, so a repeated run reuses the group with a new source
+	if sourceGroup = groupcache.GetGroup("imagio-sources"); sourceGroup == nil {
+		InitSourceGroup(1 << 20)
+	}
+	defer func() { sourceGroup = nil }()
+
+	atomic.StoreInt32(&downloads, 0)
+
+	source := "/?source=http://" + test_server + "/counted/" + strconv.FormatInt(time.Now().UnixNano(), 10) + "/" + file_name
+
+	for _, query := range []string{"&scale=100x", "&scale=200x"} {
+		o, err := Parse(source + query)
+		if err == nil {
+			err = o.Load()
+		}
+
+		if err != nil {
+			t.Fatalf("Expected source is loaded, got %v\n", err)
+		}
+
+		if o.Base.BlobLen != len(getJpeg()) {
+			t.Errorf("Expected %v bytes, got %v\n", len(getJpeg()), o.Base.BlobLen)
+		}
+	}
+
+	if n := atomic.LoadInt32(&downloads); n != 1 {
+		t.Errorf("Expected 1 download, got %v\n", n)
+	}
+
+	cfg := config.Get()
+	cfg.Sources.File.Root = "/tmp"
+	defer func() { cfg.Sources.File.Root = "" }()
+
+	keys := []struct {
+		key    string
+		status int
+	}{
+		{"file:///tmp/" + file_name, 0},
+		{"file:///etc/passwd", http.StatusForbidden},
+		{"file:///tmp/../etc/passwd", http.StatusBadRequest},
+		{"/tmp/" + file_name, http.StatusBadRequest},
+	}
+
+	for _, c := range keys {
+		src, err := fromLinkFull(c.key)
+
+		if c.status == 0 && (err != nil || src.LinkFull() != c.key) {
+			t.Errorf("Expected %v is parsed, got %v, %v\n", c.key, src, err)
+		}
+
+		if c.status != 0 && StatusOf(err) != c.status {
+			t.Errorf("Expected status %v for %v, got %v\n", c.status, c.key, err)
+		}
+	}
+}
+
+func webpHeader(chunk string, data ...byte) []byte {
+	b := append([]byte("RIFF\x00\x00\x00\x00WEBP"+chunk+"\x00\x00\x00\x00"), data...)
+
+	return append(b, make([]byte, 32)...)
+}
+
+func TestWebp(t *testing.T) {
+	// 300x200 with 14 bits per dimension
+	lossless := uint32(299) | uint32(199)<<14
+
+	cases := []struct {
+		blob  []byte
+		size  PixelDim
+		alpha bool
+	}{
+		{webpHeader("VP8 ", 0, 0, 0, 0x9d, 0x01, 0x2a, 44, 1, 200, 0), PixelDim{300, 200}, false},
+		{webpHeader("VP8L", 0x2f, byte(lossless), byte(lossless>>8), byte(lossless>>16), byte(lossless>>24)), PixelDim{300, 200}, false},
+		{webpHeader("VP8L", 0x2f, byte(lossless), byte(lossless>>8), byte(lossless>>16), byte(lossless>>24)|0x10), PixelDim{300, 200}, true},
+		{webpHeader("VP8X", 0x10, 0, 0, 0, 43, 1, 0, 199, 0, 0), PixelDim{300, 200}, true},
+	}
+
+	for i, c := range cases {
+		src, err := new(Source).fromBytes(c.blob)
+		if err != nil {
+			t.Errorf("Case %d: unable to decode config. %v\n", i, err)
+			continue
+		}
+
+		if src.Type() != "webp" || src.Mime() != "image/webp" {
+			t.Errorf("Case %d: expected webp, image/webp, got %v, %v\n", i, src.Type(), src.Mime())
+		}
+
+		if *src.Size() != c.size || src.HasAlpha() != c.alpha {
+			t.Errorf("Case %d: expected %v, alpha %v, got %v, %v\n", i, c.size, c.alpha, *src.Size(), src.HasAlpha())
+		}
+	}
+
+	if _, err := new(Source).fromBytes(webpHeader("VP8 ", 0, 0, 0, 0, 0, 0)); StatusOf(err) != http.StatusUnsupportedMediaType {
+		t.Errorf("Expected status %v for broken webp, got %v\n", http.StatusUnsupportedMediaType, err)
+	}
+}
+
+func TestHasAlpha(t *testing.T) {
+	rect := image.Rect(0, 0, 10, 10)
+	transparent := image.NewNRGBA(rect)
+	transparent.Set(1, 1, color.NRGBA{255, 0, 0, 128})
+
+	cases := []struct {
+		img   image.Image
+		alpha bool
+	}{
+		// opaque images are encoded as truecolor png without alpha, 8 and 16 bits
+		{opaque(image.NewRGBA(rect)), false},
+		{opaque(image.NewRGBA64(rect)), false},
+		{transparent, true},
+		{image.NewPaletted(rect, color.Palette{color.Black, color.White}), false},
+		{image.NewPaletted(rect, color.Palette{color.Black, color.Transparent}), true},
+	}
+
+	for i, c := range cases {
+		buf := &bytes.Buffer{}
+		if err := png.Encode(buf, c.img); err != nil {
+			t.Fatal(err)
+		}
+
+		src, err := new(Source).fromBytes(buf.Bytes())
+		if err != nil {
+			t.Errorf("Case %d: unable to decode config. %v\n", i, err)
+			continue
+		}
+
+		if src.HasAlpha() != c.alpha {
+			t.Errorf("Case %d: expected alpha %v for %T, got %v\n", i, c.alpha, src.Imgcfg.ColorModel, src.HasAlpha())
+		}
+	}
+}
+
+func opaque(img draw.Image) draw.Image {
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	return img
+}
+
+func TestNegotiate(t *testing.T) {
+	cases := map[string]string{
+		"image/avif,image/webp,image/apng,image/*,*/*;q=0.8": "webp",
+		"image/webp;q=0.9, */*":                              "webp",
+		"image/webp;q=0, */*":                                "jpeg",
+		"image/png,image/*;q=0.8,*/*;q=0.5":                  "jpeg",
+		"":                                                   "jpeg",
+	}
+
+	for accept, want := range cases {
+		o, err := Parse("/?source=http://" + test_server + "/" + file_name + "&format=auto")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !o.Negotiate(accept) || o.Format != AUTO {
+			t.Errorf("Expected format is resolved on load for '%v', got %v\n", accept, o.Format)
+		}
+
+		// the key keeps the negotiated result
+		o, err = ParseKey(o.Key())
+		if err == nil {
+			err = o.Load()
+		}
+
+		if err != nil || o.Format != want {
+			t.Errorf("Expected format %v for '%v', got %v, %v\n", want, accept, o.Format, err)
+		}
+	}
+
+	// gif keeps animation, even if webp is accepted
+	img := image.NewPaletted(image.Rect(0, 0, 10, 10), color.Palette{color.Black, color.White})
+	buf := new(bytes.Buffer)
+	gif.EncodeAll(buf, &gif.GIF{Image: []*image.Paletted{img, img}, Delay: []int{10, 10}})
+
+	if err := ioutil.WriteFile("/tmp/imagio-negotiate.gif", buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Unable to create testing content. %v\n", err)
+	}
+
+	config.Get().Sources.File.Root = "/tmp"
+
+	for query, want := range map[string]string{"": "gif", "&first_frame=true": "webp"} {
+		o, err := Parse("/?source=file://imagio-negotiate.gif&format=auto" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		o.Negotiate("image/webp,*/*")
+
+		if err := o.Load(); err != nil || o.Format != want {
+			t.Errorf("Expected format %v for gif source with '%v', got %v, %v\n", want, query, o.Format, err)
+		}
+	}
+
+	o, err := Parse("/?source=http://" + test_server + "/" + file_name + "&format=png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o.Negotiate("image/webp") || o.Format != "png" {
+		t.Errorf("Expected explicit format is not negotiated, got %v\n", o.Format)
+	}
+
+	// not negotiated auto is resolved by the source
+	o, err = Parse("/?source=http://" + test_server + "/" + file_name + "&format=auto")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := o.Key()
+
+	if err := o.Load(); err != nil || o.Format != "jpeg" {
+		t.Errorf("Expected jpeg for opaque source, got %v, %v\n", o.Format, err)
+	}
+
+	if back, _ := ParseKey(key); back == nil || back.Format != AUTO {
+		t.Errorf("Expected auto format in key %v\n", key)
+	}
+
+	// the negotiation result can't be given in the query
+	if o, _ := Parse("/?source=http://" + test_server + "/" + file_name + "&format=auto&accept_webp=true"); o == nil || o.AcceptWebp || o.Key() != key {
+		t.Errorf("Expected accept_webp is ignored in query, got %v\n", o)
+	}
+
+	if f := FormatOf(getJpeg()); f != "jpeg" {
+		t.Errorf("Expected jpeg, got %v\n", f)
+	}
+}
+
+// exifJpeg makes a 40x20 jpeg with EXIF orientation in big or little endian TIFF.
+func exifJpeg(orientation uint16, order binary.ByteOrder) []byte {
+	buf := new(bytes.Buffer)
+	jpeg.Encode(buf, image.NewGray(image.Rect(0, 0, 40, 20)), nil)
+
+	tiff := make([]byte, 26)
+	copy(tiff, "MM")
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	}
+
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+
+	app1 := append([]byte("Exif\x00\x00"), tiff...)
+	segment := []byte{0xff, 0xe1, byte((len(app1) + 2) >> 8), byte(len(app1) + 2)}
+
+	return append(append(append([]byte{0xff, 0xd8}, segment...), app1...), buf.Bytes()[2:]...)
+}
+
+func TestFit(t *testing.T) {
+	base := "/?source=http://" + test_server + "/" + file_name
+
+	cases := []struct {
+		query  string
+		zoom   PixelDim
+		roi    *Rect
+		canvas *Rect
+	}{
+		{"&scale=800x600", PixelDim{800, 600}, nil, nil},
+		{"&scale=400x600", PixelDim{400, 300}, nil, nil},
+		{"&scale=2000x2000", PixelDim{1024, 768}, nil, nil},
+		{"&scale=300x300&fit=fill", PixelDim{300, 300}, nil, nil},
+		{"&scale=300x300&fit=cover", PixelDim{300, 300}, &Rect{128, 0, 768, 768}, nil},
+		{"&scale=300x300&fit=cover&gravity=left", PixelDim{300, 300}, &Rect{0, 0, 768, 768}, nil},
+		{"&scale=100x100&fit=cover&crop=center,500,400", PixelDim{100, 100}, &Rect{312, 184, 400, 400}, nil},
+		{"&scale=300x300&fit=contain", PixelDim{300, 225}, nil, &Rect{0, 37, 300, 300}},
+		{"&scale=2000x2000&fit=contain&gravity=bright", PixelDim{2000, 1500}, nil, &Rect{0, 500, 2000, 2000}},
+	}
+
+	for _, c := range cases {
+		o, err := Parse(base + c.query)
+		if err == nil {
+			err = o.Load()
+		}
+
+		if err != nil {
+			t.Fatalf("Unable to load %v. %v\n", c.query, err)
+		}
+
+		zoom, roi, err := o.Geometry()
+		if err != nil {
+			t.Errorf("Unexpected error for %v. %v\n", c.query, err)
+			continue
+		}
+
+		if *zoom != c.zoom || !reflect.DeepEqual(roi, c.roi) || !reflect.DeepEqual(o.Canvas(zoom), c.canvas) {
+			t.Errorf("Expected %v, %v, %v for %v, got %v, %v, %v\n", c.zoom, c.roi, c.canvas, c.query, *zoom, roi, o.Canvas(zoom))
+		}
+	}
+}
+
+func TestRotate(t *testing.T) {
+	base := "/?source=http://" + test_server + "/" + file_name
+
+	cases := []struct {
+		query string
+		size  PixelDim
+	}{
+		{"&rotate=90", PixelDim{768, 1024}},
+		{"&rotate=-90&flip=v", PixelDim{768, 1024}},
+		{"&rotate=180", PixelDim{1024, 768}},
+		{"&rotate=45", PixelDim{1267, 1267}},
+		{"&rotate=90&crop=0,0,768,1024", PixelDim{768, 1024}},
+		{"&rotate=90&scale=x512", PixelDim{384, 512}},
+	}
+
+	for _, c := range cases {
+		o, err := Parse(base + c.query)
+		if err == nil {
+			err = o.Load()
+		}
+
+		if err != nil {
+			t.Fatalf("Unable to load %v. %v\n", c.query, err)
+		}
+
+		zoom, roi, err := o.Geometry()
+		if err != nil {
+			t.Errorf("Unexpected error for %v. %v\n", c.query, err)
+			continue
+		}
+
+		result := zoom
+		if result == nil {
+			result = &PixelDim{roi.Width, roi.Height}
+		}
+
+		if *result != c.size {
+			t.Errorf("Expected %v for %v, got %v\n", c.size, c.query, *result)
+		}
+	}
+
+	// center is calculated for the rotated image
+	o, _ := Parse(base + "&rotate=90&crop=center,500,500")
+	o.Load()
+
+	if _, roi, err := o.Geometry(); err != nil || *roi != (Rect{134, 262, 500, 500}) {
+		t.Errorf("Expected crop %v, got %v, %v\n", Rect{134, 262, 500, 500}, roi, err)
+	}
+}
+
+func TestUpscale(t *testing.T) {
+	base := "/?source=http://" + test_server + "/" + file_name
+
+	cases := []struct {
+		query  string
+		zoom   PixelDim
+		roi    *Rect
+		canvas *Rect
+	}{
+		{"&scale=2048x", PixelDim{2048, 1536}, nil, nil},
+		{"&scale=2048x&enlarge=false", PixelDim{1024, 768}, nil, nil},
+		{"&scale=300x&dpr=2", PixelDim{600, 450}, nil, nil},
+		{"&scale=800x&dpr=2&enlarge=false", PixelDim{1024, 768}, nil, nil},
+		{"&scale=0.5&dpr=1.5", PixelDim{768, 576}, nil, nil},
+		{"&scale=100x&crop=0,0,50,50&enlarge=false", PixelDim{50, 50}, &Rect{0, 0, 50, 50}, nil},
+		{"&scale=800x600&dpr=2", PixelDim{1024, 768}, nil, nil},
+		{"&scale=300x300&fit=cover&dpr=2", PixelDim{600, 600}, &Rect{128, 0, 768, 768}, nil},
+		{"&scale=500x500&fit=cover&dpr=2&enlarge=false", PixelDim{768, 768}, &Rect{128, 0, 768, 768}, nil},
+		{"&scale=400x400&fit=contain&dpr=2&enlarge=false", PixelDim{800, 600}, nil, &Rect{0, 100, 800, 800}},
+	}
+
+	for _, c := range cases {
+		o, err := Parse(base + c.query)
+		if err == nil {
+			err = o.Load()
+		}
+
+		if err != nil {
+			t.Fatalf("Unable to load %v. %v\n", c.query, err)
+		}
+
+		zoom, roi, err := o.Geometry()
+		if err != nil {
+			t.Errorf("Unexpected error for %v. %v\n", c.query, err)
+			continue
+		}
+
+		if *zoom != c.zoom || !reflect.DeepEqual(roi, c.roi) || !reflect.DeepEqual(o.Canvas(zoom), c.canvas) {
+			t.Errorf("Expected %v, %v, %v for %v, got %v, %v, %v\n", c.zoom, c.roi, c.canvas, c.query, *zoom, roi, o.Canvas(zoom))
+		}
+	}
+
+	// dpr doesn't bypass output limits
+	o, _ := Parse(base + "&scale=4000x&dpr=4")
+	o.Load()
+
+	if _, _, err := o.Geometry(); StatusOf(err) != http.StatusUnprocessableEntity {
+		t.Errorf("Expected status %v for result exceeding limits, got %v\n", http.StatusUnprocessableEntity, err)
+	}
+}
+
+func TestFocal(t *testing.T) {
+	base := "/?source=http://" + test_server + "/" + file_name
+
+	cases := []struct {
+		query string
+		roi   Rect
+	}{
+		{"&crop=center,200,200&fp-x=0.25&fp-y=0.25", Rect{156, 92, 200, 200}},
+		{"&crop=center,200,200&fp-x=0.5", Rect{412, 284, 200, 200}},
+		{"&crop=center,500,500&fp-x=0&fp-y=0", Rect{0, 0, 500, 500}},
+		{"&crop=nw,500,500&fp-x=1&fp-y=1", Rect{524, 268, 500, 500}},
+		{"&crop=center,50%25,50%25&fp-x=0.75&fp-y=0.75", Rect{512, 384, 512, 384}},
+		{"&crop=10,10,100,100&fp-x=0", Rect{10, 10, 100, 100}},
+		{"&scale=300x300&fit=cover&fp-x=0.45", Rect{77, 0, 768, 768}},
+		{"&scale=300x300&fit=cover&fp-x=0.9&gravity=left", Rect{256, 0, 768, 768}},
+		{"&scale=300x300&fit=cover&fp-x=0.1", Rect{0, 0, 768, 768}},
+		// the point is related to the source, not to the cropped area
+		{"&crop=256,0,768,384&scale=300x300&fit=cover&fp-x=0.75", Rect{576, 0, 384, 384}},
+	}
+
+	for _, c := range cases {
+		o, err := Parse(base + c.query)
+		if err == nil {
+			err = o.Load()
+		}
+
+		if err != nil {
+			t.Fatalf("Unable to load %v. %v\n", c.query, err)
+		}
+
+		_, roi, err := o.Geometry()
+		if err != nil {
+			t.Errorf("Unexpected error for %v. %v\n", c.query, err)
+			continue
+		}
+
+		if *roi != c.roi {
+			t.Errorf("Expected crop %v for %v, got %v\n", c.roi, c.query, *roi)
+		}
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	cases := []struct {
+		blob        []byte
+		orientation int
+		size        PixelDim
+	}{
+		{exifJpeg(6, binary.BigEndian), 6, PixelDim{20, 40}},
+		{exifJpeg(8, binary.LittleEndian), 8, PixelDim{20, 40}},
+		{exifJpeg(3, binary.LittleEndian), 3, PixelDim{40, 20}},
+		{exifJpeg(9, binary.BigEndian), 1, PixelDim{40, 20}},
+		{getJpeg(), 1, PixelDim{1024, 768}},
+	}
+
+	for i, c := range cases {
+		src, err := new(Source).fromBytes(c.blob)
+		if err != nil {
+			t.Fatalf("Case %d: unable to decode config. %v\n", i, err)
+		}
+
+		if src.Orientation() != c.orientation || *src.Size() != c.size {
+			t.Errorf("Case %d: expected orientation %v, size %v, got %v, %v\n", i, c.orientation, c.size, src.Orientation(), *src.Size())
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	cfg := config.Get()
+	link := "/?source=http://" + test_server + "/" + file_name
+
+	cases := map[string]int{
+		link + "&scale=800x":          0,
+		link + "&scale=10000x":        http.StatusUnprocessableEntity,
+		link + "&scale=x9000":         http.StatusUnprocessableEntity,
+		link + "&crop=0,0,9000,100":   http.StatusUnprocessableEntity,
+		link + "&crop=center,500,500": 0,
+	}
+
+	for query, want := range cases {
+		o, err := Parse(query)
+		if err == nil {
+			err = o.Load()
+		}
+
+		if err == nil {
+			_, _, err = o.Geometry()
+		}
+
+		if want == 0 && err != nil {
+			t.Errorf("Expected valid geometry for %v, got %v\n", query, err)
+		}
+
+		if want != 0 && StatusOf(err) != want {
+			t.Errorf("Expected status %v for %v, got %v\n", want, query, err)
+		}
+	}
+
+	cfg.Limits.MaxPixels = 1024*768 - 1
+	defer func() { cfg.Limits.MaxPixels = 0 }()
+
+	if _, err := new(Source).fromBytes(getJpeg()); StatusOf(err) != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %v for too large source, got %v\n", http.StatusRequestEntityTooLarge, err)
+	}
+}
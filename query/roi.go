@@ -1,43 +1,93 @@
 package query
 
 import (
+	"fmt"
+	. "github.com/3d0c/imagio/utils"
 	"log"
+	"math"
+	"net/http"
 	"strconv"
 	"strings"
 )
 
 type Rect struct {
-	X      int
-	Y      int
-	Width  int
-	Height int
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
 }
 
+// Roi values are pixels or percentages of the source dimensions, e.g. `10%,10%,80%,80%`.
+// Percentages are kept aside of InitArea and are resolved in Calc.
 type Roi struct {
 	InitArea *Rect
+	percent  [4]float64
+	relative [4]bool
+	gravity  string
 	calc     func(x, y, w, h int) *Rect
+	focal    *Focal
 }
 
+// Nine-point gravity, x,y are source dimensions, w,h are roi dimensions.
 var handlers = map[string]func(int, int, int, int) *Rect{
-	"left": func(x, y, w, h int) *Rect {
+	"nw": func(x, y, w, h int) *Rect {
 		return &Rect{0, 0, w, h}
 	},
 
-	"right": func(x, y, w, h int) *Rect {
-		return &Rect{x - w, 0, w, h}
+	"n": func(x, y, w, h int) *Rect {
+		return &Rect{(x - w) / 2, 0, w, h}
 	},
 
-	"bleft": func(x, y, w, h int) *Rect {
-		return &Rect{0, y - h, w, h}
+	"ne": func(x, y, w, h int) *Rect {
+		return &Rect{x - w, 0, w, h}
 	},
 
-	"bright": func(x, y, w, h int) *Rect {
-		return &Rect{x - w, y - h, w, h}
+	"w": func(x, y, w, h int) *Rect {
+		return &Rect{0, (y - h) / 2, w, h}
 	},
 
 	"center": func(x, y, w, h int) *Rect {
 		return &Rect{(x - w) / 2, (y - h) / 2, w, h}
 	},
+
+	"e": func(x, y, w, h int) *Rect {
+		return &Rect{x - w, (y - h) / 2, w, h}
+	},
+
+	"sw": func(x, y, w, h int) *Rect {
+		return &Rect{0, y - h, w, h}
+	},
+
+	"s": func(x, y, w, h int) *Rect {
+		return &Rect{(x - w) / 2, y - h, w, h}
+	},
+
+	"se": func(x, y, w, h int) *Rect {
+		return &Rect{x - w, y - h, w, h}
+	},
+}
+
+// Aliases of gravity, they are normalized, so equal crops have equal keys.
+var gravities = map[string]string{
+	"left":         "nw",
+	"right":        "ne",
+	"bleft":        "sw",
+	"bright":       "se",
+	"top":          "n",
+	"bottom":       "s",
+	"left-center":  "w",
+	"right-center": "e",
+}
+
+// canonicalGravity returns the handler name of gravity or its alias.
+func canonicalGravity(v string) (string, bool) {
+	if name, found := gravities[v]; found {
+		v = name
+	}
+
+	_, found := handlers[v]
+
+	return v, found
 }
 
 // ->x,y,w,h     4
@@ -48,24 +98,36 @@ var handlers = map[string]func(int, int, int, int) *Rect{
 //    this.InitArea{0,0,w,h}
 //    this.calc = handlers["center"]
 //    <- calculated x,y from source image (w,h are user defined)
+//    center is one of nine-point gravity or its alias, e.g. `ne` or `bright`
 // ->x,y         2
 //    this.InitArea{x,y,0,0}
 //    this.calc = nil
 //    <- InitArea (w,h are 0)
 //
+// Every value could be a percentage, e.g. `10%,10%,80%,80%` or `center,50%,50%`.
+// With a focal point shortcuts are centered on it instead.
+//
 func (*Roi) Construct(i ...interface{}) *Roi {
-	var found bool
-
 	if len(i) != 1 {
 		log.Printf("Wrong arguments count = %d. Expecting 1\n", len(i))
 		return nil
 	}
 
-	if i[0].([]interface{})[0].(string) == "" {
+	this, err := parseRoi(i[0].([]interface{})[0].(string))
+	if err != nil {
+		log.Println(err)
 		return nil
 	}
 
-	v := i[0].([]interface{})[0].(string)
+	return this
+}
+
+func parseRoi(v string) (*Roi, error) {
+	var found bool
+
+	if v == "" {
+		return nil, nil
+	}
 
 	this := &Roi{calc: nil}
 
@@ -73,62 +135,146 @@ func (*Roi) Construct(i ...interface{}) *Roi {
 
 	switch len(parts) {
 	case 4:
-		x, err := strconv.Atoi(parts[0])
-		y, err := strconv.Atoi(parts[1])
-		w, err := strconv.Atoi(parts[2])
-		h, err := strconv.Atoi(parts[3])
-
-		this.InitArea = &Rect{x, y, w, h}
-
+		vals, err := this.parseValues(parts, 0)
 		if err != nil {
-			log.Printf("Illegal parameters: x,y,width,height should be integers, `%s` given. Error: %v\n", v, err)
-			return nil
+			return nil, NewError(http.StatusBadRequest, "Illegal parameters: x,y,width,height should be integers or percentages, `%s` given. Error: %v", v, err)
 		}
 
+		this.InitArea = &Rect{vals[0], vals[1], vals[2], vals[3]}
+
 		break
 
 	case 3:
-		w, err := strconv.Atoi(parts[1])
-		h, err := strconv.Atoi(parts[2])
-
+		vals, err := this.parseValues(parts[1:], 2)
 		if err != nil {
-			log.Println("Illegal parameters. width and height should be integers, `%s` given. Error: %v\n", v, err)
-			return nil
+			return nil, NewError(http.StatusBadRequest, "Illegal parameters. width and height should be integers or percentages, `%s` given. Error: %v", v, err)
 		}
 
-		this.InitArea = &Rect{0, 0, w, h}
+		this.InitArea = &Rect{0, 0, vals[0], vals[1]}
 
-		if this.calc, found = handlers[parts[0]]; !found {
-			log.Printf("Illegal roi shortcut `%s`\n", parts[0])
-			return nil
+		if this.gravity, found = canonicalGravity(parts[0]); !found {
+			return nil, NewError(http.StatusBadRequest, "Illegal roi shortcut `%s`", parts[0])
 		}
 
+		this.calc = handlers[this.gravity]
+
 		break
 
 	case 2:
-		x, err := strconv.Atoi(parts[0])
-		y, err := strconv.Atoi(parts[1])
-
+		vals, err := this.parseValues(parts, 0)
 		if err != nil {
-			log.Printf("Illegal parameters. x,y should be integers, `%s` given. Error: %v\n", v, err)
-			return nil
+			return nil, NewError(http.StatusBadRequest, "Illegal parameters. x,y should be integers or percentages, `%s` given. Error: %v", v, err)
 		}
 
-		this.InitArea = &Rect{x, y, 0, 0}
+		this.InitArea = &Rect{vals[0], vals[1], 0, 0}
 
 		break
 
 	default:
-		return nil
+		return nil, NewError(http.StatusBadRequest, "Illegal roi `%s`", v)
 	}
 
-	return this
+	return this, nil
+}
+
+// parseValues parses integers and percentages from 0% to 100% of x,y,width,height starting from offset,
+// percentages are stored in this.percent and their pixel values are 0 until Calc.
+func (this *Roi) parseValues(parts []string, offset int) ([]int, error) {
+	result := make([]int, len(parts))
+
+	for i, part := range parts {
+		if !strings.HasSuffix(part, "%") {
+			val, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, err
+			}
+
+			result[i] = val
+			continue
+		}
+
+		val, err := strconv.ParseFloat(strings.TrimSuffix(part, "%"), 64)
+		if err != nil {
+			return nil, err
+		}
+
+		if math.IsNaN(val) || math.IsInf(val, 0) || val < 0 || val > 100 {
+			return nil, fmt.Errorf("percentage %s is out of range", part)
+		}
+
+		this.percent[offset+i] = val
+		this.relative[offset+i] = true
+	}
+
+	return result, nil
 }
 
+// String returns normalized roi option, e.g. `center,500,500`.
+func (this *Roi) String() string {
+	a := this.InitArea
+	vals := []int{a.X, a.Y, a.Width, a.Height}
+
+	// focal point replaces any gravity
+	if this.focal != nil && this.gravity != "" {
+		return fmt.Sprintf("center,%s,%s", this.format(vals, 2), this.format(vals, 3))
+	}
+
+	if this.gravity != "" {
+		return fmt.Sprintf("%s,%s,%s", this.gravity, this.format(vals, 2), this.format(vals, 3))
+	}
+
+	if a.Width == 0 && a.Height == 0 && !this.relative[2] && !this.relative[3] {
+		return fmt.Sprintf("%s,%s", this.format(vals, 0), this.format(vals, 1))
+	}
+
+	return fmt.Sprintf("%s,%s,%s,%s", this.format(vals, 0), this.format(vals, 1), this.format(vals, 2), this.format(vals, 3))
+}
+
+func (this *Roi) format(vals []int, i int) string {
+	if this.relative[i] {
+		return strconv.FormatFloat(this.percent[i], 'f', -1, 64) + "%"
+	}
+
+	return strconv.Itoa(vals[i])
+}
+
+// Calc returns roi of the source of orig size, percentages are resolved against it.
+// Shortcuts are positioned by the focal point, if it's set.
 func (this *Roi) Calc(orig *PixelDim) *Rect {
+	area := this.area(orig)
+
 	if this.calc == nil {
+		return area
+	}
+
+	if this.focal != nil {
+		return this.focal.handler(orig.Width, orig.Height, area.Width, area.Height)
+	}
+
+	return this.calc(orig.Width, orig.Height, area.Width, area.Height)
+}
+
+func (this *Roi) area(orig *PixelDim) *Rect {
+	if !this.relative[0] && !this.relative[1] && !this.relative[2] && !this.relative[3] {
 		return this.InitArea
 	}
 
-	return this.calc(orig.Width, orig.Height, this.InitArea.Width, this.InitArea.Height)
+	result := *this.InitArea
+	vals := []*int{&result.X, &result.Y, &result.Width, &result.Height}
+
+	for i, val := range vals {
+		if !this.relative[i] {
+			continue
+		}
+
+		// x and width are percentages of source width, y and height of source height
+		dim := orig.Width
+		if i%2 == 1 {
+			dim = orig.Height
+		}
+
+		*val = int(math.Floor(float64(dim)*this.percent[i]/100 + 0.5))
+	}
+
+	return &result
 }
@@ -0,0 +1,76 @@
+package query
+
+import (
+	. "github.com/3d0c/imagio/utils"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	FLIP_H = 1
+	FLIP_V = 2
+)
+
+var flips = map[string]int{
+	"h": FLIP_H, "horizontal": FLIP_H,
+	"v": FLIP_V, "vertical": FLIP_V,
+	"hv": FLIP_H | FLIP_V, "both": FLIP_H | FLIP_V,
+}
+
+var flipNames = map[int]string{FLIP_H: "h", FLIP_V: "v", FLIP_H | FLIP_V: "hv"}
+
+// parseRotate returns clockwise angle in degrees from 0 to 360.
+func parseRotate(v string) (float64, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	angle, err := strconv.ParseFloat(v, 64)
+	if err != nil || math.IsNaN(angle) || math.IsInf(angle, 0) {
+		return 0, NewError(http.StatusBadRequest, "Illegal rotate option '%v', expected angle in degrees.", v)
+	}
+
+	if angle = math.Mod(angle, 360); angle < 0 {
+		angle += 360
+	}
+
+	return angle, nil
+}
+
+func parseFlip(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+
+	if flip, found := flips[v]; found {
+		return flip, nil
+	}
+
+	return 0, NewError(http.StatusBadRequest, "Illegal flip option '%v', expected `h`, `v` or `hv`.", v)
+}
+
+// rightAngle reports whether rotation doesn't need a fill color.
+func rightAngle(angle float64) bool {
+	return math.Mod(angle, 90) == 0
+}
+
+// rotated returns dimensions of the image rotated clockwise by angle. The result fits
+// the whole rotated image, it's calculated the same way in resizer.c.
+func rotated(size *PixelDim, angle float64) *PixelDim {
+	switch angle {
+	case 0, 180:
+		return &PixelDim{size.Width, size.Height}
+
+	case 90, 270:
+		return &PixelDim{size.Height, size.Width}
+	}
+
+	rad := angle * math.Pi / 180
+	w, h := float64(size.Width), float64(size.Height)
+
+	return &PixelDim{
+		Width:  int(math.Abs(w*math.Cos(rad)) + math.Abs(h*math.Sin(rad)) + 0.5),
+		Height: int(math.Abs(w*math.Sin(rad)) + math.Abs(h*math.Cos(rad)) + 0.5),
+	}
+}
@@ -1,8 +1,10 @@
 package query
 
 import (
+	. "github.com/3d0c/imagio/utils"
 	"log"
 	"math"
+	"net/http"
 	"strconv"
 	"strings"
 )
@@ -13,8 +15,8 @@ const (
 )
 
 type PixelDim struct {
-	Width  int
-	Height int
+	Width  int `json:"width"`
+	Height int `json:"height"`
 }
 
 type Scale struct {
@@ -29,40 +31,65 @@ func (*Scale) Construct(i ...interface{}) *Scale {
 		return nil
 	}
 
-	v := i[0].([]interface{})[0].(string)
-	if v == "" {
+	this, err := parseScale(i[0].([]interface{})[0].(string))
+	if err != nil {
+		log.Println(err)
 		return nil
 	}
 
+	return this
+}
+
+func parseScale(v string) (*Scale, error) {
+	if v == "" {
+		return nil, nil
+	}
+
 	parts := strings.Split(v, "x")
 
 	switch len(parts) {
 	case 1:
 		f, err := strconv.ParseFloat(parts[0], 32)
-		if err != nil {
-			log.Printf("Illegal scale option '%v'\n", v)
-			return nil
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f <= 0 || f > math.MaxInt32 {
+			return nil, NewError(http.StatusBadRequest, "Illegal scale option '%v'", v)
 		}
 
-		return &Scale{maxdim: f}
+		return &Scale{maxdim: f}, nil
 
 	case 2:
-		w, _ := strconv.Atoi(parts[0])
-		h, _ := strconv.Atoi(parts[1])
+		w, errw := strconv.Atoi(parts[0])
+		h, errh := strconv.Atoi(parts[1])
+
+		if (errw != nil && parts[0] != "") || (errh != nil && parts[1] != "") || w < 0 || h < 0 || w+h == 0 {
+			return nil, NewError(http.StatusBadRequest, "Illegal scale option '%v'", v)
+		}
 
 		return &Scale{
 			width:  w,
 			height: h,
-		}
+		}, nil
+	}
 
-	default:
-		log.Println("Illegal scale option '%v'\n", v)
-		return nil
+	return nil, NewError(http.StatusBadRequest, "Illegal scale option '%v'", v)
+}
+
+// String returns normalized scale option, e.g. `800x` or `0.5`.
+func (this *Scale) String() string {
+	if this.maxdim > 0 {
+		return strconv.FormatFloat(this.maxdim, 'f', -1, 64)
 	}
 
-	log.Printf("Illegal size value = '%v'\n", v)
+	result := "x"
+
+	if this.width > 0 {
+		result = strconv.Itoa(this.width) + result
+	}
+
+	if this.height > 0 {
+		result += strconv.Itoa(this.height)
+	}
 
-	return nil
+	return result
 }
 
 func (this *Scale) Size(src *PixelDim) *PixelDim {
@@ -95,13 +122,11 @@ func (this *Scale) Size(src *PixelDim) *PixelDim {
 	}
 
 	if this.maxdim >= 1 && src.Width > src.Height {
-		this.width = int(this.maxdim)
-		return this.Size(src)
+		return (&Scale{width: int(this.maxdim)}).Size(src)
 	}
 
 	if this.maxdim >= 1 && src.Width < src.Height {
-		this.height = int(this.maxdim)
-		return this.Size(src)
+		return (&Scale{height: int(this.maxdim)}).Size(src)
 	}
 
 	return &PixelDim{Width: src.Width, Height: src.Height}
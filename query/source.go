@@ -2,19 +2,29 @@ package query
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"github.com/3d0c/imagio/config"
+	"github.com/3d0c/imagio/stat"
+	. "github.com/3d0c/imagio/utils"
+	"github.com/golang/groupcache"
+	"github.com/golang/groupcache/singleflight"
 	"image"
+	"image/color"
+	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
 	"io/ioutil"
 	"log"
 	"mime"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
 )
 
 const (
@@ -22,7 +32,16 @@ const (
 	URIFULL = 2
 )
 
-var readers = map[string]func(string) (io.Reader, error){
+// Client for http sources. It doesn't use proxies, otherwise origin checks in guardedDial
+// would be applied to the proxy. Reused connections are checked by guardedTransport.
+var httpClient = &http.Client{
+	Transport: &guardedTransport{&http.Transport{
+		Proxy:       nil,
+		DialContext: guardedDial,
+	}},
+}
+
+var readers = map[string]func(*Source) (io.ReadCloser, error){
 	"http": http_reader,
 	"file": file_reader,
 }
@@ -33,9 +52,12 @@ type Source struct {
 	root     string
 	filepath string
 	blob     []byte
-	reader   func(string) (io.Reader, error)
+	reader   func(*Source) (io.ReadCloser, error)
 	Imgcfg   image.Config
 	imgtype  string
+
+	// EXIF orientation, which is applied before any transformation
+	orientation int
 }
 
 func (*Source) Construct(i ...interface{}) *Source {
@@ -44,31 +66,45 @@ func (*Source) Construct(i ...interface{}) *Source {
 		return nil
 	}
 
+	var this *Source
+	var err error
+
 	v := i[0].([]interface{})[0]
 	source := &Source{}
 
 	switch v.(type) {
 	case string:
-		return source.fromUrl(v.(string))
+		if this, err = source.fromUrl(v.(string)); this != nil {
+			err = this.Load()
+		}
 
 	case []byte:
-		return source.fromBytes(v.([]byte))
+		this, err = source.fromBytes(v.([]byte))
 
 	default:
 		log.Println("Unsupported type:", reflect.TypeOf(v))
 	}
 
-	return nil
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	return this
 }
 
-func (this *Source) fromUrl(s string) *Source {
+func (this *Source) fromUrl(s string) (*Source, error) {
 	if s == "" {
-		return nil
+		return nil, nil
 	}
 
 	var err error
 	parts := strings.Split(s, "://")
 
+	if strings.Contains(s, "\x00") || strings.Contains(s, "../") {
+		return nil, NewError(http.StatusBadRequest, "URI containts illegal characters. `%v`", s)
+	}
+
 	switch len(parts) {
 	case NOPROTO:
 		this.scheme = config.Get().Scheme()
@@ -77,77 +113,187 @@ func (this *Source) fromUrl(s string) *Source {
 
 	case URIFULL:
 		this.scheme = parts[0]
-
-		if strings.Contains(parts[1], "\x00") || strings.Contains(parts[1], "../") {
-			log.Printf("URI containts illegal characters. `%v`\n", parts[1])
-			return nil
-		}
-
 		this.filepath = filepath.Clean(parts[1])
 		break
 
 	default:
-		log.Printf("Wrong URL = '%v'\n", s)
-		return nil
+		return nil, NewError(http.StatusBadRequest, "Wrong URL = '%v'", s)
 	}
 
 	this.root, err = config.Get().Root(this.scheme)
 	if err != nil {
-		log.Println("Unable to proceed without default root for `file` scheme.", err)
-		return nil
+		return nil, NewError(http.StatusInternalServerError, "Unable to proceed without default root for `%s` scheme. %v", this.scheme, err)
 	}
 
-	if r, found := readers[this.scheme]; found {
-		this.reader = r
+	r, found := readers[this.scheme]
+	if !found {
+		return nil, NewError(http.StatusBadRequest, "Unsupported scheme `%s`", this.scheme)
 	}
 
-	if this.Blob() == nil {
-		return nil
+	this.reader = r
+
+	return this, nil
+}
+
+func (this *Source) fromBytes(b []byte) (*Source, error) {
+	this.blob = b
+	this.BlobLen = len(b)
+
+	if err := this.Load(); err != nil {
+		return nil, err
 	}
 
-	this.Imgcfg, this.imgtype, err = image.DecodeConfig(bytes.NewReader(this.Blob()))
-	if err != nil {
-		log.Printf("Unable to DecodeConfig() for resource from %v. %v\n", this.Link(), err)
+	return this, nil
+}
+
+// Load fetches the resource, if it hasn't been fetched yet, and decodes its config.
+// Sources from query are not loaded until they are really needed.
+func (this *Source) Load() error {
+	if this.imgtype != "" {
 		return nil
 	}
 
-	return this
+	if this.blob == nil {
+		if err := this.fetch(); err != nil {
+			return err
+		}
+	}
+
+	return this.decodeConfig()
 }
 
-func (this *Source) fromBytes(b []byte) *Source {
+func (this *Source) decodeConfig() error {
 	var err error
 
-	this.blob = b
-
-	this.Imgcfg, this.imgtype, err = image.DecodeConfig(bytes.NewReader(this.Blob()))
+	this.Imgcfg, this.imgtype, err = image.DecodeConfig(bytes.NewReader(this.blob))
 	if err != nil {
-		log.Printf("Unable to DecodeConfig(). %v\n", this.Link(), err)
-		return nil
+		return NewError(http.StatusUnsupportedMediaType, "Unable to DecodeConfig() for resource from %v. %v", this.Key(), err)
 	}
 
-	return this
+	if this.imgtype == "jpeg" {
+		this.orientation = jpegOrientation(this.blob)
+	}
+
+	// checked before anything is decoded, so a small file can't allocate gigabytes
+	if pixels := int64(this.Imgcfg.Width) * int64(this.Imgcfg.Height); pixels > config.Get().MaxPixels() {
+		return NewError(http.StatusRequestEntityTooLarge, "Resource %v has %dx%d pixels, maximum is %d.", this.Key(), this.Imgcfg.Width, this.Imgcfg.Height, config.Get().MaxPixels())
+	}
+
+	return nil
 }
 
-func (this *Source) Blob() []byte {
-	var err error
+// Concurrent fetches of the same source share one download.
+var fetches singleflight.Group
+
+// Group of original source images, if it's initialized, sources are fetched through it.
+var sourceGroup *groupcache.Group
+
+// InitSourceGroup creates a groupcache group, which caches source blobs by LinkFull,
+// so all transformations of a source across the peers reuse one download.
+func InitSourceGroup(size int64) *groupcache.Group {
+	sourceGroup = groupcache.NewGroup("imagio-sources", size, groupcache.GetterFunc(
+		func(ctx groupcache.Context, key string, dest groupcache.Sink) error {
+			this, err := fromLinkFull(key)
+			if err != nil {
+				return err
+			}
+
+			blob, err := this.download()
+			if err != nil {
+				return err
+			}
+
+			return dest.SetBytes(blob)
+		}),
+	)
 
-	if this.blob != nil {
-		return this.blob
+	return sourceGroup
+}
+
+// fromLinkFull is an opposite of LinkFull. Keys could come from peers, so the link should be
+// inside the root and it goes through the same checks, as a source from query.
+func fromLinkFull(key string) (*Source, error) {
+	parts := strings.SplitN(key, "://", 2)
+	if len(parts) != 2 {
+		return nil, NewError(http.StatusBadRequest, "Wrong source key = '%v'", key)
+	}
+
+	root, err := config.Get().Root(parts[0])
+	if err != nil || !strings.HasPrefix(parts[1], root) {
+		return nil, NewError(http.StatusForbidden, "Source key '%v' is out of root.", key)
+	}
+
+	this, err := new(Source).fromUrl(parts[0] + "://" + strings.TrimPrefix(parts[1], root))
+	if err == nil && this == nil {
+		err = NewError(http.StatusBadRequest, "Wrong source key = '%v'", key)
+	}
+
+	return this, err
+}
+
+func (this *Source) fetch() error {
+	var blob []byte
+
+	if sourceGroup != nil {
+		if err := sourceGroup.Get(nil, this.LinkFull(), groupcache.AllocatingByteSliceSink(&blob)); err != nil {
+			return err
+		}
+	} else {
+		v, err := fetches.Do(this.LinkFull(), func() (interface{}, error) {
+			return this.download()
+		})
+		if err != nil {
+			return err
+		}
+
+		blob = v.([]byte)
 	}
 
-	r, err := this.reader(this.Link())
+	this.blob = blob
+	this.BlobLen = len(this.blob)
+
+	return nil
+}
+
+// download is not called directly, blob is shared with other fetches and shouldn't be modified.
+func (this *Source) download() ([]byte, error) {
+	var blob []byte
+
+	start := time.Now()
+
+	defer func() {
+		stat.Fetching.Get(this.scheme).Since(start)
+		stat.FetchDuration.Since(start, this.scheme)
+		stat.FetchBytes.Add(float64(len(blob)), this.scheme)
+	}()
+
+	r, err := this.reader(this)
 	if err != nil {
-		log.Printf("Unable to open resource for: %v. %v\n", this.Link(), err)
-		return nil
+		return nil, err
 	}
 
-	this.blob, err = ioutil.ReadAll(r)
+	defer r.Close()
+
+	max := config.Get().MaxSourceSize(this.scheme)
+
+	blob, err = ioutil.ReadAll(io.LimitReader(r, max+1))
 	if err != nil {
-		log.Printf("Unable to read resource for: %v. %v\n", this.Link(), err)
-		return nil
+		return nil, fetchError(this, err)
 	}
 
-	this.BlobLen = len(this.blob)
+	if int64(len(blob)) > max {
+		return nil, NewError(http.StatusRequestEntityTooLarge, "Resource %v is larger than %d bytes.", this.Key(), max)
+	}
+
+	return blob, nil
+}
+
+func (this *Source) Blob() []byte {
+	if this.blob == nil && this.reader != nil {
+		if err := this.fetch(); err != nil {
+			log.Println(err)
+		}
+	}
 
 	return this.blob
 }
@@ -160,10 +306,42 @@ func (this *Source) Type() string {
 	return this.imgtype
 }
 
+// HasAlpha reports whether decoded color model has an alpha channel.
+func (this *Source) HasAlpha() bool {
+	switch model := this.Imgcfg.ColorModel.(type) {
+	case color.Palette:
+		for _, c := range model {
+			if _, _, _, a := c.RGBA(); a != 0xffff {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	// RGBA models are reported for opaque truecolor png as well, so only non-premultiplied ones count
+	switch this.Imgcfg.ColorModel {
+	case color.NRGBAModel, color.NRGBA64Model, color.AlphaModel, color.Alpha16Model:
+		return true
+	}
+
+	return false
+}
+
 func (this *Source) Mime() string {
+	if mimeType, found := mimeTypes[this.Type()]; found {
+		return mimeType
+	}
+
 	return mime.TypeByExtension("." + this.Type())
 }
 
+// Key is a normalized source reference, which could be parsed back by fromUrl.
+func (this *Source) Key() string {
+	return this.scheme + "://" + this.filepath
+}
+
+// LinkFull and Link contain the configured root, so they aren't shown to clients.
 func (this *Source) LinkFull() string {
 	return this.scheme + "://" + this.root + this.filepath
 }
@@ -172,24 +350,103 @@ func (this *Source) Link() string {
 	return this.root + this.filepath
 }
 
+// Size returns dimensions of the image as it's seen, i.e. after EXIF orientation is applied.
 func (this *Source) Size() *PixelDim {
+	switch this.Orientation() {
+	case TRANSPOSE, ROTATE_90, TRANSVERSE, ROTATE_270:
+		return &PixelDim{Width: this.Imgcfg.Height, Height: this.Imgcfg.Width}
+	}
+
 	return &PixelDim{Width: this.Imgcfg.Width, Height: this.Imgcfg.Height}
 }
 
-func http_reader(src string) (io.Reader, error) {
-	res, err := http.Get("http://" + src)
+// Orientation returns EXIF orientation from 1 to 8.
+func (this *Source) Orientation() int {
+	if this.orientation == 0 {
+		return 1
+	}
+
+	return this.orientation
+}
+
+func http_reader(this *Source) (io.ReadCloser, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Get().ReadTimeout("http"))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+this.Link(), nil)
+	if err != nil {
+		cancel()
+		return nil, NewError(http.StatusBadRequest, "Wrong source %v. %v", this.Key(), err)
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		cancel()
+		return nil, fetchError(this, err)
+	}
+
+	max := config.Get().MaxSourceSize("http")
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		err = NewError(http.StatusNotFound, "Resource %v not found.", this.Key())
+
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		err = NewError(http.StatusBadGateway, "Unable to get %v, origin responded with '%v'.", this.Key(), res.Status)
+
+	case res.ContentLength > max:
+		err = NewError(http.StatusRequestEntityTooLarge, "Resource %v is larger than %d bytes.", this.Key(), max)
+	}
+
 	if err != nil {
+		res.Body.Close()
+		cancel()
 		return nil, err
 	}
 
-	return res.Body, nil
+	return &cancelBody{res.Body, cancel}, nil
 }
 
-func file_reader(src string) (io.Reader, error) {
-	file, err := os.Open(src)
+// cancelBody releases the request context, when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (this *cancelBody) Close() error {
+	defer this.cancel()
+
+	return this.ReadCloser.Close()
+}
+
+func file_reader(this *Source) (io.ReadCloser, error) {
+	file, err := os.Open(this.Link())
+	if os.IsNotExist(err) {
+		return nil, NewError(http.StatusNotFound, "Resource %v not found.", this.Key())
+	}
+
 	if err != nil {
-		return nil, err
+		log.Println(err)
+		return nil, NewError(http.StatusInternalServerError, "Unable to open %v.", this.Key())
 	}
 
 	return file, nil
 }
+
+// fetchError wraps an error, which came from the origin. Timeouts are
+// reported as 504, everything else as 502. Underlying errors contain the full
+// link, so they are only logged, clients get the source key.
+func fetchError(this *Source, err error) error {
+	var e *Error
+
+	if errors.As(err, &e) {
+		return e
+	}
+
+	log.Println(err)
+
+	if e, ok := err.(net.Error); (ok && e.Timeout()) || errors.Is(err, context.DeadlineExceeded) {
+		return NewError(http.StatusGatewayTimeout, "Timeout while getting %v.", this.Key())
+	}
+
+	return NewError(http.StatusBadGateway, "Unable to get %v.", this.Key())
+}
@@ -0,0 +1,88 @@
+package query
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+)
+
+// WebP images are decoded by OpenCV, only the config is needed to check dimensions
+// and alpha channel, so the format is registered with a config decoder only.
+func init() {
+	image.RegisterFormat("webp", "RIFF????WEBP", decodeWebp, decodeWebpConfig)
+}
+
+var errWebp = errors.New("webp: invalid format")
+
+func decodeWebp(r io.Reader) (image.Image, error) {
+	return nil, errors.New("webp: decoding is not supported, only config")
+}
+
+// decodeWebpConfig reads the first chunk of RIFF container, which is one of:
+// `VP8 ` lossy, `VP8L` lossless or `VP8X` extended format. Opaque images are reported
+// with YCbCr model, images with alpha channel with NRGBA model.
+func decodeWebpConfig(r io.Reader) (image.Config, error) {
+	var header [30]byte
+
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return image.Config{}, errWebp
+	}
+
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+		return image.Config{}, errWebp
+	}
+
+	data := header[20:]
+
+	switch string(header[12:16]) {
+	case "VP8 ":
+		// frame tag (3 bytes), start code, 14 bits of width and height
+		if data[3] != 0x9d || data[4] != 0x01 || data[5] != 0x2a {
+			return image.Config{}, errWebp
+		}
+
+		return image.Config{
+			ColorModel: color.YCbCrModel,
+			Width:      int(binary.LittleEndian.Uint16(data[6:8]) & 0x3fff),
+			Height:     int(binary.LittleEndian.Uint16(data[8:10]) & 0x3fff),
+		}, nil
+
+	case "VP8L":
+		// signature, 14 bits of width-1, 14 bits of height-1, alpha bit
+		if data[0] != 0x2f {
+			return image.Config{}, errWebp
+		}
+
+		bits := binary.LittleEndian.Uint32(data[1:5])
+
+		return image.Config{
+			ColorModel: webpModel(bits>>28&1 == 1),
+			Width:      int(bits&0x3fff) + 1,
+			Height:     int(bits>>14&0x3fff) + 1,
+		}, nil
+
+	case "VP8X":
+		// flags, 3 reserved bytes, 24 bits of width-1 and height-1
+		return image.Config{
+			ColorModel: webpModel(data[0]&0x10 != 0),
+			Width:      int(uint24(data[4:7])) + 1,
+			Height:     int(uint24(data[7:10])) + 1,
+		}, nil
+	}
+
+	return image.Config{}, errWebp
+}
+
+func webpModel(alpha bool) color.Model {
+	if alpha {
+		return color.NRGBAModel
+	}
+
+	return color.YCbCrModel
+}
+
+func uint24(b []byte) uint32 {
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
+}
@@ -0,0 +1,91 @@
+// Package sign signs and verifies request URLs, so only URLs produced by a key owner
+// could be served.
+//
+// Signature is an HMAC-SHA256 of the request path and the sorted query (without `sig` itself),
+// encoded with unpadded URL-safe base64 and passed as `sig` option. Optional `expires` option
+// is a unix timestamp, after which the URL is rejected.
+package sign
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	. "github.com/3d0c/imagio/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	SIG     = "sig"
+	EXPIRES = "expires"
+)
+
+// Sign returns rawurl with a signature, made with key. Zero expires means no expiration.
+func Sign(rawurl string, key string, expires time.Time) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Del(SIG)
+
+	if !expires.IsZero() {
+		query.Set(EXPIRES, strconv.FormatInt(expires.Unix(), 10))
+	}
+
+	u.RawQuery = query.Encode()
+
+	query.Set(SIG, signature(key, u.Path, query))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// Verify checks u against each of keys, so keys could be rotated by adding a new key
+// in front of the old ones. Nothing is required, if there are no keys.
+func Verify(u *url.URL, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	query := u.Query()
+
+	sig, err := base64.RawURLEncoding.DecodeString(query.Get(SIG))
+	if err != nil || len(sig) == 0 {
+		return NewError(http.StatusForbidden, "Missing or malformed signature.")
+	}
+
+	if e := query.Get(EXPIRES); e != "" {
+		expires, err := strconv.ParseInt(e, 10, 64)
+		if err != nil {
+			return NewError(http.StatusForbidden, "Malformed `expires` option.")
+		}
+
+		if time.Now().Unix() > expires {
+			return NewError(http.StatusForbidden, "Signature has expired.")
+		}
+	}
+
+	query.Del(SIG)
+
+	for _, key := range keys {
+		expected, _ := base64.RawURLEncoding.DecodeString(signature(key, u.Path, query))
+
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+
+	return NewError(http.StatusForbidden, "Wrong signature.")
+}
+
+// signature of the path and the query, which has no `sig` option.
+func signature(key string, path string, query url.Values) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(path + "?" + query.Encode()))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
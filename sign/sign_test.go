@@ -0,0 +1,67 @@
+package sign
+
+import (
+	. "github.com/3d0c/imagio/utils"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSign(t *testing.T) {
+	keys := []string{"new-key", "old-key"}
+
+	signed := map[string]string{}
+
+	for _, key := range []string{"new-key", "old-key", "unknown-key"} {
+		s, err := Sign("/?source=1.jpg&scale=800x", key, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signed[key] = s
+	}
+
+	expired, _ := Sign("/?source=1.jpg", "new-key", time.Now().Add(-time.Minute))
+	valid, _ := Sign("/?source=1.jpg", "new-key", time.Now().Add(time.Minute))
+
+	cases := map[string]int{
+		signed["new-key"]:                   0,
+		signed["old-key"]:                   0,
+		valid:                               0,
+		signed["unknown-key"]:               http.StatusForbidden,
+		expired:                             http.StatusForbidden,
+		"/?source=1.jpg&scale=800x":         http.StatusForbidden,
+		signed["new-key"] + "&crop=1,1,5,5": http.StatusForbidden,
+		"/nocache" + signed["new-key"][1:]:  http.StatusForbidden,
+		"/?source=1.jpg&sig=not-base64!!!":  http.StatusForbidden,
+	}
+
+	for rawurl, want := range cases {
+		u, _ := url.Parse(rawurl)
+
+		err := Verify(u, keys)
+
+		if want == 0 && err != nil {
+			t.Errorf("Expected %v is valid, got %v\n", rawurl, err)
+		}
+
+		if want != 0 && (err == nil || StatusOf(err) != want) {
+			t.Errorf("Expected status %v for %v, got %v\n", want, rawurl, err)
+		}
+	}
+
+	// query order doesn't matter
+	s, _ := Sign("/?scale=800x&source=1.jpg", "new-key", time.Time{})
+	u, _ := url.Parse(s)
+	query := u.Query()
+	reordered, _ := url.Parse("/?sig=" + query.Get(SIG) + "&source=1.jpg&scale=800x")
+
+	if err := Verify(reordered, keys); err != nil {
+		t.Errorf("Expected reordered query is valid, got %v\n", err)
+	}
+
+	if err := Verify(reordered, nil); err != nil {
+		t.Errorf("Expected nothing is required without keys, got %v\n", err)
+	}
+}
@@ -0,0 +1,256 @@
+package stat
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/golang/groupcache"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default histogram buckets in seconds.
+var BUCKETS = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	RequestDuration = NewHistogramVec("imagio_request_duration_seconds", "Request duration by endpoint and status code.", BUCKETS, "endpoint", "code")
+	CgoDuration     = NewHistogramVec("imagio_cgo_duration_seconds", "Duration of OpenCV calls.", BUCKETS, "call")
+	FetchDuration   = NewHistogramVec("imagio_source_fetch_duration_seconds", "Source fetching duration by scheme.", BUCKETS, "scheme")
+	FetchBytes      = NewCounterVec("imagio_source_fetch_bytes_total", "Fetched source bytes by scheme.", "scheme")
+	OutputBytes     = NewCounterVec("imagio_output_bytes_total", "Served image bytes by format.", "format")
+
+	metrics = []metric{RequestDuration, CgoDuration, FetchDuration, FetchBytes, OutputBytes}
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+type series struct {
+	values  []string
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type vec struct {
+	sync.Mutex
+	name   string
+	help   string
+	kind   string
+	labels []string
+	series map[string]*series
+}
+
+func (this *vec) get(values []string) *series {
+	if len(values) != len(this.labels) {
+		panic(fmt.Sprintf("%s: expected %d label values, got %d", this.name, len(this.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+
+	if this.series == nil {
+		this.series = make(map[string]*series)
+	}
+
+	if _, found := this.series[key]; !found {
+		this.series[key] = &series{values: append([]string{}, values...)}
+	}
+
+	return this.series[key]
+}
+
+func (this *vec) sorted() []*series {
+	result := make([]*series, 0, len(this.series))
+
+	for _, s := range this.series {
+		result = append(result, s)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return strings.Join(result[i].values, "\xff") < strings.Join(result[j].values, "\xff")
+	})
+
+	return result
+}
+
+func (this *vec) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", this.name, this.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", this.name, this.kind)
+}
+
+type CounterVec struct {
+	vec
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{vec{name: name, help: help, kind: "counter", labels: labels}}
+}
+
+func (this *CounterVec) Add(v float64, values ...string) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.get(values).sum += v
+}
+
+func (this *CounterVec) write(w io.Writer) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.header(w)
+
+	for _, s := range this.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", this.name, labels(this.labels, s.values), float(s.sum))
+	}
+}
+
+type HistogramVec struct {
+	vec
+	bounds []float64
+}
+
+func NewHistogramVec(name, help string, bounds []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{vec: vec{name: name, help: help, kind: "histogram", labels: labels}, bounds: bounds}
+}
+
+func (this *HistogramVec) Observe(v float64, values ...string) {
+	this.Lock()
+	defer this.Unlock()
+
+	s := this.get(values)
+
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(this.bounds))
+	}
+
+	for i, bound := range this.bounds {
+		if v <= bound {
+			s.buckets[i]++
+		}
+	}
+
+	s.sum += v
+	s.count++
+}
+
+// Since observes duration in seconds, e.g. `defer stat.CgoDuration.Since(time.Now(), "resize")`.
+func (this *HistogramVec) Since(start time.Time, values ...string) {
+	this.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (this *HistogramVec) write(w io.Writer) {
+	this.Lock()
+	defer this.Unlock()
+
+	this.header(w)
+
+	for _, s := range this.sorted() {
+		names := append(append([]string{}, this.labels...), "le")
+		values := append(append([]string{}, s.values...), "")
+
+		for i, bound := range this.bounds {
+			values[len(values)-1] = float(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", this.name, labels(names, values), s.buckets[i])
+		}
+
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", this.name, labels(names, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", this.name, labels(this.labels, s.values), float(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", this.name, labels(this.labels, s.values), s.count)
+	}
+}
+
+// WriteMetrics writes all metrics and stats of given groupcache groups
+// in Prometheus text exposition format.
+func WriteMetrics(out io.Writer, groups ...*groupcache.Group) error {
+	w := bufio.NewWriter(out)
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+
+	writeGroups(w, groups)
+
+	return w.Flush()
+}
+
+func writeGroups(w io.Writer, groups []*groupcache.Group) {
+	counters := []struct {
+		name string
+		help string
+		get  func(*groupcache.Group) int64
+	}{
+		{"imagio_groupcache_gets_total", "Groupcache get requests.", func(g *groupcache.Group) int64 { return g.Stats.Gets.Get() }},
+		{"imagio_groupcache_hits_total", "Groupcache hits.", func(g *groupcache.Group) int64 { return g.Stats.CacheHits.Get() }},
+		{"imagio_groupcache_misses_total", "Groupcache misses.", func(g *groupcache.Group) int64 { return g.Stats.Gets.Get() - g.Stats.CacheHits.Get() }},
+		{"imagio_groupcache_peer_loads_total", "Groupcache loads from peers.", func(g *groupcache.Group) int64 { return g.Stats.PeerLoads.Get() }},
+		{"imagio_groupcache_peer_errors_total", "Groupcache peer errors.", func(g *groupcache.Group) int64 { return g.Stats.PeerErrors.Get() }},
+		{"imagio_groupcache_local_loads_total", "Groupcache local loads.", func(g *groupcache.Group) int64 { return g.Stats.LocalLoads.Get() }},
+		{"imagio_groupcache_local_load_errors_total", "Groupcache local load errors.", func(g *groupcache.Group) int64 { return g.Stats.LocalLoadErrs.Get() }},
+	}
+
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+		for _, g := range groups {
+			if g != nil {
+				fmt.Fprintf(w, "%s%s %d\n", c.name, labels([]string{"group"}, []string{g.Name()}), c.get(g))
+			}
+		}
+	}
+
+	caches := []struct {
+		name string
+		help string
+		kind string
+		get  func(groupcache.CacheStats) int64
+	}{
+		{"imagio_groupcache_cache_bytes", "Groupcache cache size in bytes.", "gauge", func(s groupcache.CacheStats) int64 { return s.Bytes }},
+		{"imagio_groupcache_cache_items", "Groupcache cache items.", "gauge", func(s groupcache.CacheStats) int64 { return s.Items }},
+		{"imagio_groupcache_cache_evictions_total", "Groupcache cache evictions.", "counter", func(s groupcache.CacheStats) int64 { return s.Evictions }},
+	}
+
+	for _, c := range caches {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", c.name, c.help, c.name, c.kind)
+
+		for _, g := range groups {
+			if g == nil {
+				continue
+			}
+
+			fmt.Fprintf(w, "%s%s %d\n", c.name, labels([]string{"group", "cache"}, []string{g.Name(), "main"}), c.get(g.CacheStats(groupcache.MainCache)))
+			fmt.Fprintf(w, "%s%s %d\n", c.name, labels([]string{"group", "cache"}, []string{g.Name(), "hot"}), c.get(g.CacheStats(groupcache.HotCache)))
+		}
+	}
+}
+
+func labels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+
+	for i, name := range names {
+		pairs[i] = name + `="` + escape(values[i]) + `"`
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func float(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
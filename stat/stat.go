@@ -0,0 +1,282 @@
+package stat
+
+import (
+	"github.com/golang/groupcache"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Count of the latest samples, percentiles are calculated from.
+const WINDOW = 1024
+
+var (
+	Requests   = &RequestCounter{}
+	Processing = &Timings{}
+	Fetching   = &TimingsSet{}
+	Workers    = &WorkersReport{}
+
+	started = time.Now()
+)
+
+// RequestCounter counts served requests by endpoint and response status.
+type RequestCounter struct {
+	sync.Mutex
+	counts map[string]map[int]int64
+}
+
+func (this *RequestCounter) Add(endpoint string, status int) {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.counts == nil {
+		this.counts = make(map[string]map[int]int64)
+	}
+
+	if this.counts[endpoint] == nil {
+		this.counts[endpoint] = make(map[int]int64)
+	}
+
+	this.counts[endpoint][status]++
+}
+
+func (this *RequestCounter) Snapshot() map[string]map[int]int64 {
+	this.Lock()
+	defer this.Unlock()
+
+	result := make(map[string]map[int]int64, len(this.counts))
+
+	for endpoint, byStatus := range this.counts {
+		result[endpoint] = make(map[int]int64, len(byStatus))
+
+		for status, count := range byStatus {
+			result[endpoint][status] = count
+		}
+	}
+
+	return result
+}
+
+// Timings keeps the latest WINDOW durations.
+type Timings struct {
+	sync.Mutex
+	samples []time.Duration
+	next    int
+	count   int64
+}
+
+// Summary of timings in milliseconds.
+type Summary struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+func (this *Timings) Observe(d time.Duration) {
+	this.Lock()
+	defer this.Unlock()
+
+	if len(this.samples) < WINDOW {
+		this.samples = append(this.samples, d)
+	} else {
+		this.samples[this.next] = d
+	}
+
+	this.next = (this.next + 1) % WINDOW
+	this.count++
+}
+
+// Since is a shortcut for `defer stat.Processing.Since(time.Now())`.
+func (this *Timings) Since(start time.Time) {
+	this.Observe(time.Since(start))
+}
+
+func (this *Timings) Summary() *Summary {
+	this.Lock()
+	sorted := make([]time.Duration, len(this.samples))
+	copy(sorted, this.samples)
+	result := &Summary{Count: this.count}
+	this.Unlock()
+
+	if len(sorted) == 0 {
+		return result
+	}
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	result.P50 = ms(percentile(sorted, 0.5))
+	result.P90 = ms(percentile(sorted, 0.9))
+	result.P99 = ms(percentile(sorted, 0.99))
+	result.Max = ms(sorted[len(sorted)-1])
+
+	return result
+}
+
+// TimingsSet is a set of Timings by name, e.g. by source scheme.
+type TimingsSet struct {
+	sync.Mutex
+	timings map[string]*Timings
+}
+
+func (this *TimingsSet) Get(name string) *Timings {
+	this.Lock()
+	defer this.Unlock()
+
+	if this.timings == nil {
+		this.timings = make(map[string]*Timings)
+	}
+
+	if _, found := this.timings[name]; !found {
+		this.timings[name] = &Timings{}
+	}
+
+	return this.timings[name]
+}
+
+func (this *TimingsSet) Summary() map[string]*Summary {
+	this.Lock()
+	defer this.Unlock()
+
+	result := make(map[string]*Summary, len(this.timings))
+
+	for name, timings := range this.timings {
+		result[name] = timings.Summary()
+	}
+
+	return result
+}
+
+type CacheReport struct {
+	Main           groupcache.CacheStats `json:"main"`
+	Hot            groupcache.CacheStats `json:"hot"`
+	Gets           int64                 `json:"gets"`
+	CacheHits      int64                 `json:"cache_hits"`
+	PeerLoads      int64                 `json:"peer_loads"`
+	PeerErrors     int64                 `json:"peer_errors"`
+	Loads          int64                 `json:"loads"`
+	LoadsDeduped   int64                 `json:"loads_deduped"`
+	LocalLoads     int64                 `json:"local_loads"`
+	LocalLoadErrs  int64                 `json:"local_load_errors"`
+	ServerRequests int64                 `json:"server_requests"`
+}
+
+// WorkersReport is updated by the processing pool with sync/atomic. Cancelled counts requests,
+// which stopped waiting for a worker or for a shared result, because the client is gone.
+type WorkersReport struct {
+	Size      int64 `json:"size"`
+	Queue     int64 `json:"queue"`
+	Busy      int64 `json:"busy"`
+	Waiting   int64 `json:"waiting"`
+	Rejected  int64 `json:"rejected"`
+	TimedOut  int64 `json:"timed_out"`
+	Cancelled int64 `json:"cancelled"`
+}
+
+type RuntimeReport struct {
+	Goroutines int    `json:"goroutines"`
+	Alloc      uint64 `json:"alloc"`
+	TotalAlloc uint64 `json:"total_alloc"`
+	Sys        uint64 `json:"sys"`
+	HeapInuse  uint64 `json:"heap_inuse"`
+	NumGC      uint32 `json:"num_gc"`
+}
+
+type Report struct {
+	Uptime     float64                  `json:"uptime"`
+	Requests   map[string]map[int]int64 `json:"requests"`
+	Processing *Summary                 `json:"processing"`
+	Workers    *WorkersReport           `json:"workers"`
+	Fetching   map[string]*Summary      `json:"fetching"`
+	Cache      map[string]*CacheReport  `json:"groupcache"`
+	Runtime    *RuntimeReport           `json:"runtime"`
+}
+
+// Collect builds a report for all counters and for given groupcache groups.
+func Collect(groups ...*groupcache.Group) *Report {
+	var mem runtime.MemStats
+
+	runtime.ReadMemStats(&mem)
+
+	this := &Report{
+		Uptime:     time.Since(started).Seconds(),
+		Requests:   Requests.Snapshot(),
+		Processing: Processing.Summary(),
+		Workers: &WorkersReport{
+			Size:     atomic.LoadInt64(&Workers.Size),
+			Queue:    atomic.LoadInt64(&Workers.Queue),
+			Busy:     atomic.LoadInt64(&Workers.Busy),
+			Waiting:  atomic.LoadInt64(&Workers.Waiting),
+			Rejected: atomic.LoadInt64(&Workers.Rejected),
+			TimedOut: atomic.LoadInt64(&Workers.TimedOut),
+		},
+		Fetching: Fetching.Summary(),
+		Cache:    make(map[string]*CacheReport, len(groups)),
+		Runtime: &RuntimeReport{
+			Goroutines: runtime.NumGoroutine(),
+			Alloc:      mem.Alloc,
+			TotalAlloc: mem.TotalAlloc,
+			Sys:        mem.Sys,
+			HeapInuse:  mem.HeapInuse,
+			NumGC:      mem.NumGC,
+		},
+	}
+
+	for _, g := range groups {
+		if g == nil {
+			continue
+		}
+
+		this.Cache[g.Name()] = &CacheReport{
+			Main:           g.CacheStats(groupcache.MainCache),
+			Hot:            g.CacheStats(groupcache.HotCache),
+			Gets:           g.Stats.Gets.Get(),
+			CacheHits:      g.Stats.CacheHits.Get(),
+			PeerLoads:      g.Stats.PeerLoads.Get(),
+			PeerErrors:     g.Stats.PeerErrors.Get(),
+			Loads:          g.Stats.Loads.Get(),
+			LoadsDeduped:   g.Stats.LoadsDeduped.Get(),
+			LocalLoads:     g.Stats.LocalLoads.Get(),
+			LocalLoadErrs:  g.Stats.LocalLoadErrs.Get(),
+			ServerRequests: g.Stats.ServerRequests.Get(),
+		}
+	}
+
+	return this
+}
+
+// Handler counts requests to endpoint and observes their duration by response status.
+func Handler(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		h(rw, r)
+
+		Requests.Add(endpoint, rw.status)
+		RequestDuration.Since(start, endpoint, strconv.Itoa(rw.status))
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (this *statusWriter) WriteHeader(status int) {
+	this.status = status
+	this.ResponseWriter.WriteHeader(status)
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
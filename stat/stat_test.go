@@ -0,0 +1,92 @@
+package stat
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimings(t *testing.T) {
+	timings := &Timings{}
+
+	for i := 1; i <= WINDOW+100; i++ {
+		timings.Observe(time.Duration(i) * time.Millisecond)
+	}
+
+	s := timings.Summary()
+
+	if s.Count != WINDOW+100 {
+		t.Errorf("Expected count is %v, got %v\n", WINDOW+100, s.Count)
+	}
+
+	// the first 100 samples are out of window
+	if s.Max != WINDOW+100 || s.P50 != 100+WINDOW/2 {
+		t.Errorf("Unexpected summary %v\n", s)
+	}
+
+	if (&Timings{}).Summary().Count != 0 {
+		t.Errorf("Expected empty summary for empty timings\n")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h := Handler("/test", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			http.NotFound(w, r)
+		}
+	})
+
+	// Requests is global, so only the increments are checked
+	before := Requests.Snapshot()["/test"]
+
+	for _, u := range []string{"/test", "/test", "/test?fail=1"} {
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", u, nil))
+	}
+
+	counts := Requests.Snapshot()["/test"]
+
+	if counts[http.StatusOK]-before[http.StatusOK] != 2 || counts[http.StatusNotFound]-before[http.StatusNotFound] != 1 {
+		t.Errorf("Unexpected counts %v, before %v\n", counts, before)
+	}
+
+	if len(Collect().Requests["/test"]) != 2 {
+		t.Errorf("Expected requests in report\n")
+	}
+}
+
+func TestWriteMetrics(t *testing.T) {
+	h := NewHistogramVec("test_duration_seconds", "Test.", []float64{0.1, 1}, "call")
+	c := NewCounterVec("test_bytes_total", "Test.", "format")
+
+	h.Observe(0.05, "resize")
+	h.Observe(0.5, "resize")
+	h.Observe(5, "resize")
+	c.Add(100, `j"peg`)
+
+	metrics = append(metrics, h, c)
+
+	buf := &bytes.Buffer{}
+	if err := WriteMetrics(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"# TYPE test_duration_seconds histogram\n",
+		`test_duration_seconds_bucket{call="resize",le="0.1"} 1` + "\n",
+		`test_duration_seconds_bucket{call="resize",le="1"} 2` + "\n",
+		`test_duration_seconds_bucket{call="resize",le="+Inf"} 3` + "\n",
+		`test_duration_seconds_sum{call="resize"} 5.55` + "\n",
+		`test_duration_seconds_count{call="resize"} 3` + "\n",
+		"# TYPE test_bytes_total counter\n",
+		`test_bytes_total{format="j\"peg"} 100` + "\n",
+	}
+
+	for _, line := range expected {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("Expected %q in:\n%s", line, buf.String())
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Error is an error, which knows the HTTP status it should be reported with.
+type Error struct {
+	Status  int
+	Message string
+
+	// If it's set, response will have a Retry-After header.
+	RetryAfter time.Duration
+}
+
+func NewError(status int, format string, args ...interface{}) *Error {
+	return &Error{Status: status, Message: fmt.Sprintf(format, args...)}
+}
+
+func (this *Error) Error() string {
+	return this.Message
+}
+
+// StatusOf returns HTTP status code for err. Errors, which are not an *Error,
+// are internal ones.
+func StatusOf(err error) int {
+	if e, ok := err.(*Error); ok {
+		return e.Status
+	}
+
+	return http.StatusInternalServerError
+}
+
+// WriteError responds with a small JSON document, e.g.:
+//
+//	{"status":404,"error":"Not Found","message":"..."}
+func WriteError(w http.ResponseWriter, err error) {
+	status := StatusOf(err)
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"status":  status,
+		"error":   http.StatusText(status),
+		"message": err.Error(),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if e, ok := err.(*Error); ok && e.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+
+	w.WriteHeader(status)
+	w.Write(body)
+}
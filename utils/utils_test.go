@@ -1,7 +1,11 @@
 package utils
 
 import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 type Foo struct {
@@ -18,3 +22,35 @@ func TestConstruct(t *testing.T) {
 		t.Errorf("x.Bar = '%v' want 'xxx'", x.Bar)
 	}
 }
+
+func TestStatusOf(t *testing.T) {
+	if status := StatusOf(NewError(http.StatusNotFound, "not found")); status != http.StatusNotFound {
+		t.Errorf("Expected status %v, got %v", http.StatusNotFound, status)
+	}
+
+	if status := StatusOf(errors.New("oops")); status != http.StatusInternalServerError {
+		t.Errorf("Expected status %v, got %v", http.StatusInternalServerError, status)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	WriteError(w, &Error{Status: http.StatusServiceUnavailable, Message: "busy", RetryAfter: 1500 * time.Millisecond})
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %v, got %v", http.StatusServiceUnavailable, w.Code)
+	}
+
+	if v := w.Header().Get("Retry-After"); v != "2" {
+		t.Errorf("Expected Retry-After 2, got '%v'", v)
+	}
+
+	w = httptest.NewRecorder()
+
+	WriteError(w, errors.New("oops"))
+
+	if v := w.Header().Get("Retry-After"); v != "" {
+		t.Errorf("Unexpected Retry-After '%v'", v)
+	}
+}